@@ -31,14 +31,64 @@ type GitRepoSpec struct {
 	// +optional
 	GitPath string `json:"gitpath"`
 
+	// SecretName is the namespace/name of a Secret with the credentials to fetch
+	// the repo and the remote paths of its operations. It holds either an ssh
+	// private key as identity with an optional known_hosts, or a username and password.
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+
+	// Decryption decrypts SOPS encrypted Secrets in the rendered manifests.
+	// +optional
+	Decryption *Decryption `json:"decryption,omitempty"`
+
 	// Store is a location to store operation artifacts after they have been released
 	// +optional
 	Store `json:"store,omitempty"`
 
+	// ServiceAccountName is the namespace/name of a ServiceAccount to impersonate
+	// when applying and deleting the objects of the operations.
+	// +optional
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// Policy restricts what the operations may apply.
+	// +optional
+	Policy *Policy `json:"policy,omitempty"`
+
 	// Operations: list of Operations
 	Operations []Operation `json:"operations"`
 }
 
+// Decryption is where the keys for SOPS encrypted Secrets are.
+type Decryption struct {
+	// SecretName is the namespace/name of a Secret with the keys, age keys
+	// in entries ending with .agekey and armored PGP private keys in entries
+	// ending with .asc.
+	SecretName string `json:"secretName"`
+	// IgnoreMAC skips the SOPS MAC check, which covers every value of a Secret
+	// as the renderer outputs it, for renderers that change its metadata.
+	// Each encrypted value is still authenticated by its own encryption.
+	// +optional
+	IgnoreMAC bool `json:"ignoreMAC,omitempty"`
+}
+
+// Policy restricts the namespaces and kinds the operations of a GitRepo may apply.
+type Policy struct {
+	// Namespaces objects may be applied to as globs, all namespaces when empty.
+	// Namespace objects are matched by their name.
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+	// AllowedKinds are the only kinds that may be applied as Kind.group globs,
+	// core kinds have no group. All kinds when empty.
+	// +optional
+	AllowedKinds []string `json:"allowedKinds,omitempty"`
+	// DeniedKinds may never be applied, as Kind.group globs.
+	// +optional
+	DeniedKinds []string `json:"deniedKinds,omitempty"`
+	// ClusterScoped allows cluster-scoped objects other than Namespaces.
+	// +optional
+	ClusterScoped bool `json:"clusterScoped,omitempty"`
+}
+
 // Store defines a cloud object store.
 type Store struct {
 
@@ -53,14 +103,46 @@ type Store struct {
 type Operation struct {
 	// Name of the operation.
 	Name string `json:"operation"`
-	// Path to kustomize files.
+	// Path to kustomize files, or to the chart for the helm renderer.
 	Path string `json:"path"`
+	// Renderer produces the manifests of the operation from the Path.
+	// Defaults to kustomize.
+	// +optional
+	Renderer Renderer `json:"renderer,omitempty"`
+	// Kustomize configures the kustomize renderer.
+	// +optional
+	Kustomize *KustomizeOptions `json:"kustomize,omitempty"`
+	// Helm configures the helm renderer.
+	// +optional
+	Helm *HelmSource `json:"helm,omitempty"`
+	// Raw configures the raw renderer.
+	// +optional
+	Raw *RawSource `json:"raw,omitempty"`
+	// Jsonnet configures the jsonnet renderer.
+	// +optional
+	Jsonnet *JsonnetSource `json:"jsonnet,omitempty"`
 	// HashPath adds a kustomize ref of the commit hash to the end of the Path
 	// +optional
 	HashPath bool `json:"hashpath"`
 	// Weight to determin order
 	// +optional
 	Weight int64 `json:"weight,omitempty"`
+	// Timeout is how long the operations sharing this weight may take to
+	// become ready before the stage is marked as failed. Defaults to 5m.
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+	// Namespace for the namespaced objects of the operation that do not set
+	// one, cluster-scoped objects are never namespaced. Defaults to default.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// Target is a remote cluster to apply the operation to, when not set
+	// the operation is applied to the cluster Slipway runs in.
+	// +optional
+	Target *Target `json:"target,omitempty"`
+	// FailurePolicy decides if the other operations of the Hash proceed when
+	// this operation fails to render or apply. Defaults to Halt.
+	// +optional
+	FailurePolicy FailurePolicy `json:"failurePolicy,omitempty"`
 	// Type of Operation
 	// kubebuilder:validation:MinLength=1
 	Type OpType `json:"optype"`
@@ -75,6 +157,107 @@ type Operation struct {
 	Transformers []Transformer `json:"transformers"`
 }
 
+// Renderer produces the manifests of an operation
+// +kubebuilder:validation:Enum=kustomize;helm;raw;jsonnet
+type Renderer string
+
+const (
+	// RendererKustomize builds the Path with kustomize.
+	RendererKustomize Renderer = "kustomize"
+	// RendererHelm renders the chart at the Path with helm template.
+	RendererHelm Renderer = "helm"
+	// RendererRaw loads the manifest files under the Path.
+	RendererRaw Renderer = "raw"
+	// RendererJsonnet evaluates a jsonnet file in the Path.
+	RendererJsonnet Renderer = "jsonnet"
+)
+
+// KustomizeOptions are the build options of the kustomize renderer. Helm
+// chart inflation and components need a newer kustomize than Slipway is
+// built with.
+type KustomizeOptions struct {
+	// LoadRestrictor decides which files a kustomization may load. Defaults
+	// to LoadRestrictionsRootOnly.
+	// +optional
+	LoadRestrictor LoadRestrictor `json:"loadRestrictor,omitempty"`
+	// EnablePlugins allows the exec and Go kustomize plugins installed in the
+	// kustomize plugin home of the controller.
+	// +optional
+	EnablePlugins bool `json:"enablePlugins,omitempty"`
+}
+
+// LoadRestrictor decides which files a kustomization may load
+// +kubebuilder:validation:Enum=LoadRestrictionsRootOnly;LoadRestrictionsNone
+type LoadRestrictor string
+
+const (
+	// LoadRestrictionsRootOnly only allows files under the kustomization.
+	LoadRestrictionsRootOnly LoadRestrictor = "LoadRestrictionsRootOnly"
+	// LoadRestrictionsNone allows files outside the kustomization that are
+	// in the same repository, only for remote paths.
+	LoadRestrictionsNone LoadRestrictor = "LoadRestrictionsNone"
+)
+
+// HelmSource is how a chart is rendered.
+type HelmSource struct {
+	// ReleaseName of the chart. Defaults to the name of the operation.
+	// +optional
+	ReleaseName string `json:"releaseName,omitempty"`
+	// ValuesFiles are paths of values files relative to the chart, they have
+	// to be in the same repository. Later files take precedence.
+	// +optional
+	ValuesFiles []string `json:"valuesFiles,omitempty"`
+	// Values in YAML, they take precedence over the values files.
+	// +optional
+	Values string `json:"values,omitempty"`
+}
+
+// RawSource is which manifest files are loaded. Globs are matched against the
+// path of a file relative to the Path, globs without a slash also match its name.
+type RawSource struct {
+	// Include globs of the files to load. Defaults to *.yaml, *.yml and *.json.
+	// +optional
+	Include []string `json:"include,omitempty"`
+	// Exclude globs of files not to load, they take precedence over Include.
+	// +optional
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// JsonnetSource is how jsonnet is evaluated. The commit, referenceTitle, opType
+// and gitRepo external variables describe the reference being rendered.
+type JsonnetSource struct {
+	// File to evaluate relative to the Path. Defaults to main.jsonnet.
+	// +optional
+	File string `json:"file,omitempty"`
+	// LibPaths are library directories relative to the Path, they have to
+	// be in the same repository.
+	// +optional
+	LibPaths []string `json:"libPaths,omitempty"`
+}
+
+// FailurePolicy is what happens to a Hash when one of its operations fails
+// +kubebuilder:validation:Enum=Halt;Continue
+type FailurePolicy string
+
+const (
+	// FailurePolicyHalt stops the Hash at the failed operation.
+	FailurePolicyHalt FailurePolicy = "Halt"
+	// FailurePolicyContinue keeps the objects of the failed operation and
+	// proceeds with the other operations.
+	FailurePolicyContinue FailurePolicy = "Continue"
+)
+
+// Target is a remote cluster reached with a kubeconfig stored in a Secret.
+type Target struct {
+	// Name of the Secret holding the kubeconfig.
+	Name string `json:"name"`
+	// Namespace of the Secret holding the kubeconfig.
+	Namespace string `json:"namespace"`
+	// Key of the kubeconfig in the Secret. Defaults to kubeconfig.
+	// +optional
+	Key string `json:"key,omitempty"`
+}
+
 // OpType is the type of operation that will take place
 // +kubebuilder:validation:Enum=tag;branch;pull;highesttag
 type OpType string
@@ -82,13 +265,58 @@ type OpType string
 // Transformers are kustomize transformers available for contextual
 // transformation that cannot be accomplished with normal kustomize manifests
 type Transformer struct {
-	// Type of tranformer valid types annotations, images, labels, namespace, prefix, suffix
+	// Type of tranformer valid types annotations, images, labels, namespace, prefix, suffix,
+	// replicas, resources, patch, gitmetadata or the name of a transformer plugin
 	Type string `json:"type"`
 	// Value to use with transformer valid types are hash, pull, branch, tag
+	// +optional
 	Value string `json:"value"`
-	// Key value for tools like labels and annotations
+	// Key value for tools like labels and annotations, the image name for
+	// images, the workload name for replicas and resources, the ConfigMap name
+	// for gitmetadata
 	// +optional
 	Key string `json:"key"`
+	// Sanitize makes the value of namespace, prefix and suffix transformers a
+	// valid DNS-1123 label, a hash of the value is appended when it changes.
+	// Defaults to true.
+	// +optional
+	Sanitize *bool `json:"sanitize,omitempty"`
+	// Patch is a strategic merge or JSON6902 patch for the patch transformer,
+	// it is a template of the reference like values.
+	// +optional
+	Patch string `json:"patch,omitempty"`
+	// Target selects the objects the patch transformer patches. A strategic
+	// merge patch without a target patches the object it names.
+	// +optional
+	Target *PatchTarget `json:"target,omitempty"`
+	// NewName replaces the name of the images selected by an images
+	// transformer, it is a template of the reference like values.
+	// +optional
+	NewName string `json:"newName,omitempty"`
+	// Env adds the ConfigMap of the gitmetadata transformer to the environment
+	// of the containers of every workload.
+	// +optional
+	Env bool `json:"env,omitempty"`
+}
+
+// PatchTarget selects the objects of a patch transformer
+type PatchTarget struct {
+	// +optional
+	Group string `json:"group,omitempty"`
+	// +optional
+	Version string `json:"version,omitempty"`
+	// +optional
+	Kind string `json:"kind,omitempty"`
+	// +optional
+	Name string `json:"name,omitempty"`
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// LabelSelector selects objects by their labels.
+	// +optional
+	LabelSelector string `json:"labelSelector,omitempty"`
+	// AnnotationSelector selects objects by their annotations.
+	// +optional
+	AnnotationSelector string `json:"annotationSelector,omitempty"`
 }
 
 // GitRepoStatus defines the observed state of GitRepo
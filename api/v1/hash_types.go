@@ -33,6 +33,10 @@ type HashSpec struct {
 	// +kubebuilder:validation:Required
 	GitRepo string `json:"gitrepo"`
 
+	// Uri is the location of the repo of the GitRepo.
+	// +optional
+	Uri string `json:"uri,omitempty"`
+
 	// Operations to perform
 	// +kubebuilder:validation:Required
 	// +listType:=atomic
@@ -41,6 +45,24 @@ type HashSpec struct {
 	// Store Backup storage type
 	// +optional
 	*Store `json:"store,omitempty"`
+
+	// SecretName is the namespace/name of the Secret with the git credentials
+	// of the GitRepo.
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+
+	// Decryption of the GitRepo for SOPS encrypted Secrets.
+	// +optional
+	Decryption *Decryption `json:"decryption,omitempty"`
+
+	// ServiceAccountName is the namespace/name of the ServiceAccount of the
+	// GitRepo to impersonate.
+	// +optional
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// Policy of the GitRepo restricting what may be applied.
+	// +optional
+	Policy *Policy `json:"policy,omitempty"`
 }
 
 // HashStatus defines the observed state of Hash
@@ -48,11 +70,221 @@ type HashStatus struct {
 	// A list of pointers to current deployed objects.
 	// +optional
 	Objects []corev1.ObjectReference `json:"active,omitempty"`
+	// Targets are the objects deployed to remote clusters.
+	// +optional
+	Targets []TargetStatus `json:"targets,omitempty"`
+	// Rejected are the objects the policy did not allow to be applied.
+	// +optional
+	Rejected []RejectedObject `json:"rejected,omitempty"`
+	// Operations are the results of the last apply of each operation.
+	// +optional
+	Operations []OperationStatus `json:"operations,omitempty"`
+	// Stages tracks the rollout of the operations grouped by weight.
+	// +optional
+	Stages []StageStatus `json:"stages,omitempty"`
+	// Health is computed from the status of every object owned by the Hash.
+	// +optional
+	Health HealthStatus `json:"health,omitempty"`
+	// ObservedGeneration is the last generation of the Hash that was reconciled.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions are the Ready, Progressing and Degraded conditions of the Hash.
+	// +optional
+	Conditions []Condition `json:"conditions,omitempty"`
+	// Hooks are the results of the hook Jobs run for the operations.
+	// +optional
+	Hooks []HookStatus `json:"hooks,omitempty"`
+}
+
+// OperationStatus is the result of the last apply of an operation.
+type OperationStatus struct {
+	// Name of the operation.
+	Name string `json:"name"`
+	// ReferenceTitle is the branch, tag or pull request the operation matched.
+	// +optional
+	ReferenceTitle string `json:"referenceTitle,omitempty"`
+	// Digest is the sha256 of the rendered manifests.
+	// +optional
+	Digest string `json:"digest,omitempty"`
+	// Sanitized are the transformer values changed to be valid names.
+	// +optional
+	Sanitized []SanitizedValue `json:"sanitized,omitempty"`
+	// A list of pointers to the objects applied by the operation.
+	// +optional
+	Objects []corev1.ObjectReference `json:"active,omitempty"`
+	// LastAppliedTime is when the operation was last applied completely.
+	// +optional
+	LastAppliedTime *metav1.Time `json:"lastAppliedTime,omitempty"`
+	// LastError is the error of the last failed attempt, cleared by a successful apply.
+	// +optional
+	LastError string `json:"lastError,omitempty"`
+	// LastErrorReason is a CamelCase reason for the last error, such as Forbidden.
+	// +optional
+	LastErrorReason string `json:"lastErrorReason,omitempty"`
+	// Attempts is the number of consecutive failed attempts.
+	// +optional
+	Attempts int32 `json:"attempts,omitempty"`
+}
+
+// SanitizedValue is a transformer value changed to be a valid DNS-1123 label.
+type SanitizedValue struct {
+	// Transformer type the value is for.
+	Transformer string `json:"transformer"`
+	// Value before it was sanitized.
+	Value string `json:"value"`
+	// Sanitized value that was used.
+	Sanitized string `json:"sanitized"`
+}
+
+// RejectedObject is an object of an operation rejected by the GitRepo policy.
+type RejectedObject struct {
+	// Operation that rendered the object.
+	Operation string `json:"operation"`
+	// Object that was rejected.
+	Object corev1.ObjectReference `json:"object"`
+	// Message is why the object was rejected.
+	Message string `json:"message"`
+}
+
+// TargetStatus lists the objects deployed to a remote cluster.
+type TargetStatus struct {
+	// Target is the namespace/name of the Secret of the remote cluster,
+	// followed by :key when the kubeconfig is not under the default key.
+	Target string `json:"target"`
+	// A list of pointers to the objects deployed to the remote cluster.
+	// +optional
+	Objects []corev1.ObjectReference `json:"active,omitempty"`
+}
+
+// HookType is the moment a hook Job is run
+// +kubebuilder:validation:Enum=pre-apply;post-apply;pre-delete
+type HookType string
+
+const (
+	// HookPreApply runs before the objects of an operation are applied.
+	HookPreApply HookType = "pre-apply"
+	// HookPostApply runs once the stage of an operation is ready.
+	HookPostApply HookType = "post-apply"
+	// HookPreDelete runs before the objects of a deleted Hash are removed.
+	HookPreDelete HookType = "pre-delete"
+)
+
+// HookPhase is the phase of a hook Job
+// +kubebuilder:validation:Enum=Running;Succeeded;Failed
+type HookPhase string
+
+const (
+	// HookRunning means the Job has not finished.
+	HookRunning HookPhase = "Running"
+	// HookSucceeded means the Job completed.
+	HookSucceeded HookPhase = "Succeeded"
+	// HookFailed means the Job failed.
+	HookFailed HookPhase = "Failed"
+)
+
+// HookStatus is the result of a hook Job run for an operation.
+type HookStatus struct {
+	// Operation the hook belongs to.
+	Operation string `json:"operation"`
+	// Type of hook.
+	Type HookType `json:"type"`
+	// Name of the Job.
+	Name string `json:"name"`
+	// Namespace of the Job.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// Phase of the Job.
+	Phase HookPhase `json:"phase"`
+	// StartTime is when the Job was created.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// CompletionTime is when the Job succeeded or failed.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// Message describes the result of the Job.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// HealthStatus is the assessed health of a Hash
+// +kubebuilder:validation:Enum=Healthy;Progressing;Degraded
+type HealthStatus string
+
+const (
+	// HealthHealthy means every object is ready.
+	HealthHealthy HealthStatus = "Healthy"
+	// HealthProgressing means objects are still rolling out.
+	HealthProgressing HealthStatus = "Progressing"
+	// HealthDegraded means an object or stage failed.
+	HealthDegraded HealthStatus = "Degraded"
+)
+
+// ConditionType is the type of a Hash condition
+type ConditionType string
+
+const (
+	// ConditionReady is True when every stage is applied and every object is healthy.
+	ConditionReady ConditionType = "Ready"
+	// ConditionProgressing is True while objects are rolling out.
+	ConditionProgressing ConditionType = "Progressing"
+	// ConditionDegraded is True when an object or stage failed.
+	ConditionDegraded ConditionType = "Degraded"
+)
+
+// Condition describes one aspect of the state of a Hash.
+type Condition struct {
+	// Type of condition.
+	Type ConditionType `json:"type"`
+	// Status of the condition, one of True, False, Unknown.
+	Status corev1.ConditionStatus `json:"status"`
+	// ObservedGeneration is the generation of the Hash the condition was set for.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// LastTransitionTime is the last time the condition changed status.
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// Reason is a CamelCase reason for the last transition.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// Message is a human readable explanation of the condition.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// StagePhase is the rollout phase of a stage
+// +kubebuilder:validation:Enum=Progressing;Ready;Failed
+type StagePhase string
+
+const (
+	// StageProgressing means objects in the stage are not ready yet.
+	StageProgressing StagePhase = "Progressing"
+	// StageReady means every object in the stage is ready.
+	StageReady StagePhase = "Ready"
+	// StageFailed means the stage timed out or an object failed.
+	StageFailed StagePhase = "Failed"
+)
+
+// StageStatus is the rollout state of all operations sharing a weight.
+// Operations with a higher weight are not applied until the stage is Ready.
+type StageStatus struct {
+	// Weight of the operations in this stage.
+	Weight int64 `json:"weight"`
+	// Phase of the stage.
+	Phase StagePhase `json:"phase"`
+	// StartTime is when the stage started waiting for its objects.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// Message describes what the stage is waiting on.
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:resource:path=hashes,scope=Cluster
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="GitRepo",type=string,JSONPath=`.spec.gitrepo`
+// +kubebuilder:printcolumn:name="Health",type=string,JSONPath=`.status.health`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 // Hash is the Schema for the hashes API
 type Hash struct {
 	metav1.TypeMeta   `json:",inline"`
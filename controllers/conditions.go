@@ -0,0 +1,151 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	unstruct "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+
+	gitv1 "github.com/slipway-gitops/slipway/api/v1"
+)
+
+// assessHealth computes the health of a Hash from the objects its policy
+// rejected, its failed operations, its stages and the current state of every
+// object it owns, with the reason and message for its conditions.
+func (r *HashReconciler) assessHealth(ctx context.Context, hash *gitv1.Hash) (gitv1.HealthStatus, string, string) {
+	health, reason, message := gitv1.HealthHealthy, "Ready", "All objects are healthy"
+	if len(hash.Status.Rejected) > 0 {
+		rej := hash.Status.Rejected[0]
+		return gitv1.HealthDegraded,
+			"PolicyViolation",
+			fmt.Sprintf("%d objects rejected, Kind:%s Named:%s %s",
+				len(hash.Status.Rejected),
+				rej.Object.Kind,
+				rej.Object.Name,
+				rej.Message,
+			)
+	}
+	for _, op := range hash.Status.Operations {
+		if op.LastError != "" {
+			reason := op.LastErrorReason
+			if reason == "" {
+				reason = "OperationFailed"
+			}
+			return gitv1.HealthDegraded,
+				reason,
+				fmt.Sprintf("Operation %s failed %d times: %s", op.Name, op.Attempts, op.LastError)
+		}
+	}
+	for _, stage := range hash.Status.Stages {
+		switch stage.Phase {
+		case gitv1.StageFailed:
+			return gitv1.HealthDegraded,
+				"StageFailed",
+				fmt.Sprintf("Stage weight:%d %s", stage.Weight, stage.Message)
+		case gitv1.StageProgressing:
+			health, reason, message = gitv1.HealthProgressing,
+				"StageProgressing",
+				fmt.Sprintf("Stage weight:%d %s", stage.Weight, stage.Message)
+		}
+	}
+	for _, key := range targetKeys(hash) {
+		objs := objectReferences(hash, key)
+		if len(objs) == 0 {
+			continue
+		}
+		c, err := r.clusterForKey(ctx, r.Log, hash, key)
+		if err != nil {
+			return gitv1.HealthDegraded,
+				"TargetUnavailable",
+				fmt.Sprintf("Target:%s %s", key, err)
+		}
+		for _, obj := range objs {
+			u := &unstruct.Unstructured{}
+			u.SetGroupVersionKind(obj.GroupVersionKind())
+			var objHealth gitv1.HealthStatus
+			var objMessage string
+			if err := c.Get(ctx, types.NamespacedName{Name: obj.Name, Namespace: obj.Namespace}, u); err != nil {
+				objHealth, objMessage = gitv1.HealthProgressing, err.Error()
+			} else {
+				objHealth, objMessage = objectHealth(u)
+			}
+			if worseHealth(health, objHealth) == health {
+				continue
+			}
+			health = objHealth
+			reason = fmt.Sprintf("Object%s", objHealth)
+			message = fmt.Sprintf("Kind:%s Named:%s in Namespace:%s %s",
+				obj.Kind,
+				obj.Name,
+				obj.Namespace,
+				objMessage,
+			)
+			if key != "" {
+				message = fmt.Sprintf("Target:%s %s", key, message)
+			}
+		}
+	}
+	return health, reason, message
+}
+
+// setHealth records the health of a Hash as its Ready, Progressing and Degraded conditions.
+func setHealth(hash *gitv1.Hash, health gitv1.HealthStatus, reason, message string, now metav1.Time) {
+	hash.Status.Health = health
+	hash.Status.ObservedGeneration = hash.Generation
+	// The conditions are always added in the same order
+	for _, c := range []struct {
+		conditionType gitv1.ConditionType
+		isTrue        bool
+	}{
+		{gitv1.ConditionReady, health == gitv1.HealthHealthy},
+		{gitv1.ConditionProgressing, health == gitv1.HealthProgressing},
+		{gitv1.ConditionDegraded, health == gitv1.HealthDegraded},
+	} {
+		status := corev1.ConditionFalse
+		if c.isTrue {
+			status = corev1.ConditionTrue
+		}
+		hash.Status.Conditions = setCondition(hash.Status.Conditions, gitv1.Condition{
+			Type:               c.conditionType,
+			Status:             status,
+			ObservedGeneration: hash.Generation,
+			LastTransitionTime: now,
+			Reason:             reason,
+			Message:            message,
+		})
+	}
+}
+
+// setCondition adds or replaces the condition of the same type,
+// the transition time is only moved when the status changes.
+func setCondition(conditions []gitv1.Condition, condition gitv1.Condition) []gitv1.Condition {
+	for i, c := range conditions {
+		if c.Type != condition.Type {
+			continue
+		}
+		if c.Status == condition.Status {
+			condition.LastTransitionTime = c.LastTransitionTime
+		}
+		conditions[i] = condition
+		return conditions
+	}
+	return append(conditions, condition)
+}
@@ -0,0 +1,123 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Keys of a git credentials Secret
+const (
+	gitIdentityKey   = "identity"
+	gitKnownHostsKey = "known_hosts"
+	gitUsernameKey   = "username"
+	gitPasswordKey   = "password"
+)
+
+var (
+	ErrInvalidSecretName = errors.New("Invalid Secret name, expected namespace/name")
+	ErrNoCredentials     = errors.New("No identity or username and password in git Secret")
+)
+
+// gitAuth returns the auth to fetch a repository with from the git credentials
+// Secret. Without a Secret ssh repositories use the key in ~/.ssh/id_rsa and
+// other repositories are fetched anonymously.
+func gitAuth(ctx context.Context, c client.Client, secretName, uri string) (transport.AuthMethod, error) {
+	endpoint, err := transport.NewEndpoint(uri)
+	if err != nil {
+		return nil, err
+	}
+	if secretName == "" {
+		if endpoint.Protocol != "ssh" {
+			return nil, nil
+		}
+		return getSSHKeyAuth()
+	}
+	var secret corev1.Secret
+	if err := getSecret(ctx, c, secretName, &secret); err != nil {
+		return nil, err
+	}
+	return secretAuth(&secret, endpoint)
+}
+
+// getSecret gets a Secret by its namespace/name.
+func getSecret(ctx context.Context, c client.Client, secretName string, secret *corev1.Secret) error {
+	parts := strings.Split(secretName, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("%w: %s", ErrInvalidSecretName, secretName)
+	}
+	return c.Get(ctx, types.NamespacedName{Namespace: parts[0], Name: parts[1]}, secret)
+}
+
+// secretAuth builds the auth for an endpoint from a git credentials Secret.
+func secretAuth(secret *corev1.Secret, endpoint *transport.Endpoint) (transport.AuthMethod, error) {
+	if identity, ok := secret.Data[gitIdentityKey]; ok && endpoint.Protocol == "ssh" {
+		signer, err := ssh.ParsePrivateKey(identity)
+		if err != nil {
+			return nil, err
+		}
+		user := endpoint.User
+		if user == "" {
+			user = "git"
+		}
+		auth := &gitssh.PublicKeys{User: user, Signer: signer}
+		if knownHosts, ok := secret.Data[gitKnownHostsKey]; ok {
+			if auth.HostKeyCallback, err = knownHostsCallback(knownHosts); err != nil {
+				return nil, err
+			}
+		}
+		return auth, nil
+	}
+	if username, ok := secret.Data[gitUsernameKey]; ok && endpoint.Protocol != "ssh" {
+		return &githttp.BasicAuth{
+			Username: string(username),
+			Password: string(secret.Data[gitPasswordKey]),
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: %s/%s", ErrNoCredentials, secret.Namespace, secret.Name)
+}
+
+// knownHostsCallback verifies host keys against known_hosts content, it is
+// only read from a file so the file is removed once loaded.
+func knownHostsCallback(knownHosts []byte) (ssh.HostKeyCallback, error) {
+	f, err := ioutil.TempFile("", "known_hosts")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(knownHosts); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return gitssh.NewKnownHostsCallback(f.Name())
+}
@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestSecretAuth(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	secret := &corev1.Secret{Data: map[string][]byte{
+		gitIdentityKey:   identity,
+		gitKnownHostsKey: []byte("github.com ssh-rsa AAAAB3NzaC1yc2EAAAABIwAAAQEAq2A7hRGmdnm9tUDbO9IDSwBK6TbQa+PXYPCPy6rbTrTtw7PHkccKrpp0yVhp5HdEIcKr6pLlVDBfOLX9QUsyCOV0wzfjIJNlGEYsdlLJizHhbn2mUjvSAHQqZETYP81eFzLQNnPHt4EVVUh7VfDESU84KezmD5QlWpXLmvU31/yMf+Se8xhHTvKSCZIFImWwoG6mbUoWf9nzpIoaSjB+weqqUUmpaaasXVal72J+UX2B+2RPW3RcT0eOzQgqlJL3RKrTJvdsjE3JEAvGq3lGHSZXy28G3skua2SmVi/w4yCE6gbODqnTWlg7+wC604ydGXA8VJiS5ap43JXiUFFAaQ=="),
+		gitUsernameKey:   []byte("slipway"),
+		gitPasswordKey:   []byte("token"),
+	}}
+
+	ssh, _ := transport.NewEndpoint("git@github.com:slipway-gitops/slipway-example-app.git")
+	auth, err := secretAuth(secret, ssh)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if keys, ok := auth.(*gitssh.PublicKeys); !ok || keys.User != "git" || keys.HostKeyCallback == nil {
+		t.Errorf("Expected ssh keys with a host key callback got %v", auth)
+	}
+
+	https, _ := transport.NewEndpoint("https://github.com/slipway-gitops/slipway-example-app.git")
+	auth, err = secretAuth(secret, https)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if basic, ok := auth.(*githttp.BasicAuth); !ok || basic.Username != "slipway" || basic.Password != "token" {
+		t.Errorf("Expected basic auth got %v", auth)
+	}
+
+	delete(secret.Data, gitIdentityKey)
+	if _, err := secretAuth(secret, ssh); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("Expected no credentials error got %v", err)
+	}
+	if _, err := gitAuth(context.Background(), nil, "slipway", "git@github.com:slipway-gitops/slipway-example-app.git"); !errors.Is(err, ErrInvalidSecretName) {
+		t.Errorf("Expected invalid secret name error got %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	unstruct "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/kustomize/api/resmap"
+
+	gitv1 "github.com/slipway-gitops/slipway/api/v1"
+)
+
+// Suffixes of the keys in a decryption Secret
+const (
+	ageKeySuffix = ".agekey"
+	pgpKeySuffix = ".asc"
+)
+
+var (
+	ErrNoDecryption     = errors.New("Encrypted Secret without decryption set")
+	ErrNoDecryptionKeys = errors.New("No age or PGP keys in decryption Secret")
+	ErrNotRendered      = errors.New("Encrypted Secret not in the rendered manifests")
+)
+
+// sopsEncrypted reports if an object is a SOPS encrypted Secret.
+func sopsEncrypted(u *unstruct.Unstructured) bool {
+	_, ok := u.Object["sops"]
+	return ok && u.GroupVersionKind().GroupKind().String() == "Secret"
+}
+
+// sopsMAC is the MAC of a SOPS encrypted object, it identifies the object
+// as rendered after transformers changed its metadata.
+func sopsMAC(obj map[string]interface{}) string {
+	mac, _, _ := unstruct.NestedString(obj, "sops", "mac")
+	return mac
+}
+
+// encryptedSecrets returns the SOPS encrypted Secrets of the renderer output
+// before transformers change the metadata their MAC covers. They are what
+// sops decrypts, they stay encrypted in the render cache.
+func encryptedSecrets(m resmap.ResMap) ([]json.RawMessage, error) {
+	objs, err := decodeResources(m)
+	if err != nil {
+		return nil, err
+	}
+	var encrypted []json.RawMessage
+	for _, u := range objs {
+		if !sopsEncrypted(u) {
+			continue
+		}
+		data, err := json.Marshal(u.Object)
+		if err != nil {
+			return nil, err
+		}
+		encrypted = append(encrypted, data)
+	}
+	return encrypted, nil
+}
+
+// decryptSecrets decrypts the SOPS encrypted Secrets in objs in place. sops
+// decrypts the Secret from the renderer output in encrypted, objs keep the
+// metadata set by transformers and setScope and take everything else from it.
+// The plain text only exists in memory and on the cluster, it is never logged,
+// cached or saved to the store.
+func (r *HashReconciler) decryptSecrets(
+	ctx context.Context,
+	hash *gitv1.Hash,
+	objs []*unstruct.Unstructured,
+	encrypted []json.RawMessage,
+) error {
+	var secrets []*unstruct.Unstructured
+	for _, u := range objs {
+		if sopsEncrypted(u) {
+			secrets = append(secrets, u)
+		}
+	}
+	if len(secrets) == 0 {
+		return nil
+	}
+	if hash.Spec.Decryption == nil {
+		return fmt.Errorf("%w: Kind:Secret Named:%s", ErrNoDecryption, secrets[0].GetName())
+	}
+	rendered := make(map[string]json.RawMessage)
+	for _, data := range encrypted {
+		obj := make(map[string]interface{})
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return err
+		}
+		rendered[sopsMAC(obj)] = data
+	}
+	var secret corev1.Secret
+	if err := getSecret(ctx, r.Client, hash.Spec.Decryption.SecretName, &secret); err != nil {
+		return err
+	}
+	env, cleanup, err := r.sopsEnv(ctx, &secret)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	for _, u := range secrets {
+		data, ok := rendered[sopsMAC(u.Object)]
+		if !ok {
+			return fmt.Errorf("%w: Kind:Secret Named:%s", ErrNotRendered, u.GetName())
+		}
+		decrypted, err := r.sopsDecrypt(ctx, env, hash.Spec.Decryption.IgnoreMAC, data)
+		if err != nil {
+			return fmt.Errorf("Kind:Secret Named:%s: %w", u.GetName(), err)
+		}
+		delete(u.Object, "sops")
+		for field, val := range decrypted {
+			switch field {
+			case "apiVersion", "kind", "metadata", "sops":
+			default:
+				u.Object[field] = val
+			}
+		}
+	}
+	return nil
+}
+
+// sopsDecrypt decrypts an object with sops through stdin and stdout. The MAC
+// is only skipped when ignoreMAC is set.
+func (r *HashReconciler) sopsDecrypt(ctx context.Context, env []string, ignoreMAC bool, data []byte) (map[string]interface{}, error) {
+	args := []string{"--decrypt"}
+	if ignoreMAC {
+		args = append(args, "--ignore-mac")
+	}
+	args = append(args,
+		"--input-type", "json",
+		"--output-type", "json",
+		"/dev/stdin",
+	)
+	cmd := exec.CommandContext(ctx, r.SopsBinary, args...)
+	cmd.Env = env
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := runCommand(cmd)
+	if err != nil {
+		return nil, err
+	}
+	decrypted := make(map[string]interface{})
+	if err := json.Unmarshal(out, &decrypted); err != nil {
+		return nil, err
+	}
+	return decrypted, nil
+}
+
+// sopsEnv builds the environment for sops from the keys of the decryption
+// Secret. Age keys are written to a key file and PGP keys are imported into a
+// keyring, both in a temporary directory removed by cleanup.
+func (r *HashReconciler) sopsEnv(ctx context.Context, secret *corev1.Secret) (env []string, cleanup func(), err error) {
+	cleanup = func() {}
+	var names []string
+	for name := range secret.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var ageKeys []string
+	var pgpKeys [][]byte
+	for _, name := range names {
+		switch {
+		case strings.HasSuffix(name, ageKeySuffix):
+			ageKeys = append(ageKeys, strings.TrimSpace(string(secret.Data[name])))
+		case strings.HasSuffix(name, pgpKeySuffix):
+			pgpKeys = append(pgpKeys, secret.Data[name])
+		}
+	}
+	if len(ageKeys) == 0 && len(pgpKeys) == 0 {
+		return nil, cleanup, fmt.Errorf("%w: %s/%s", ErrNoDecryptionKeys, secret.Namespace, secret.Name)
+	}
+
+	// The directory is only accessible by the controller
+	dir, err := ioutil.TempDir("", "sops")
+	if err != nil {
+		return nil, cleanup, err
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	env = os.Environ()
+	if len(ageKeys) > 0 {
+		keyFile := filepath.Join(dir, "keys.txt")
+		if err := ioutil.WriteFile(keyFile, []byte(strings.Join(ageKeys, "\n")+"\n"), 0600); err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		env = append(env, "SOPS_AGE_KEY_FILE="+keyFile)
+	}
+	if len(pgpKeys) > 0 {
+		home := filepath.Join(dir, "gnupg")
+		if err := os.Mkdir(home, 0700); err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		env = append(env, "GNUPGHOME="+home)
+		for _, key := range pgpKeys {
+			cmd := exec.CommandContext(ctx, "gpg", "--batch", "--import")
+			cmd.Env = env
+			cmd.Stdin = bytes.NewReader(key)
+			if _, err := runCommand(cmd); err != nil {
+				cleanup()
+				return nil, func() {}, err
+			}
+		}
+	}
+	return env, cleanup, nil
+}
+
+// loggedObject is how an object is logged, Secrets are only logged by name.
+func loggedObject(u *unstruct.Unstructured) interface{} {
+	if u.GroupVersionKind().GroupKind().String() == "Secret" {
+		return fmt.Sprintf("Kind:Secret Named:%s in Namespace:%s", u.GetName(), u.GetNamespace())
+	}
+	return u
+}
@@ -0,0 +1,178 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "github.com/slipway-gitops/slipway/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	unstruct "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	kscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// fakeSops writes a sops that replaces the encrypted values when it is given
+// the age key file. Like the MAC it fails when the metadata is not the one
+// encrypted, unless --ignore-mac is set. Its arguments and key file are kept
+// to be checked.
+func fakeSops(t *testing.T, dir string) string {
+	sops := filepath.Join(dir, "sops")
+	script := "#!/bin/sh\n[ \"$(cat \"$SOPS_AGE_KEY_FILE\")\" = \"AGE-SECRET-KEY-1\" ] || { echo no key >&2; exit 1; }\n" +
+		"echo \"$@\" > " + filepath.Join(dir, "args") + "\n" +
+		"echo \"$SOPS_AGE_KEY_FILE\" > " + filepath.Join(dir, "keyfile") + "\n" +
+		"in=$(cat)\n" +
+		"case \"$*\" in *--ignore-mac*) ;; *) echo \"$in\" | grep -qF '\"metadata\":{\"name\":\"db\"}' || { echo MAC mismatch >&2; exit 1; } ;; esac\n" +
+		"echo \"$in\" | sed 's/ENC\\[AES256_GCM,data:[^]]*\\]/cGxhaW4=/'\n"
+	if err := ioutil.WriteFile(sops, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return sops
+}
+
+// encryptedSecret is a Secret as sops encrypts it.
+func encryptedSecret() *unstruct.Unstructured {
+	u := newObject("v1", "Secret", nil)
+	u.SetName("db")
+	unstruct.SetNestedField(u.Object, "ENC[AES256_GCM,data:abc,tag:def,type:str]", "data", "password")
+	unstruct.SetNestedField(u.Object, "ENC[AES256_GCM,data:mac,tag:def,type:str]", "sops", "mac")
+	unstruct.SetNestedField(u.Object, "3.7.1", "sops", "version")
+	return u
+}
+
+func TestDecryptSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keys := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "sops-keys", Namespace: "slipway"},
+		Data:       map[string][]byte{"app" + ageKeySuffix: []byte("AGE-SECRET-KEY-1\n")},
+	}
+	r := &HashReconciler{Client: fake.NewFakeClientWithScheme(kscheme.Scheme, keys), SopsBinary: fakeSops(t, dir)}
+
+	raw, _ := json.Marshal(encryptedSecret().Object)
+	rendered := []json.RawMessage{raw}
+	encrypted := encryptedSecret()
+	plain := newObject("v1", "Secret", nil)
+	plain.SetName("plain")
+	unstruct.SetNestedField(plain.Object, "ENC[AES256_GCM,data:abc,tag:def,type:str]", "data", "password")
+	objs := []*unstruct.Unstructured{encrypted, plain}
+
+	hash := &v1.Hash{}
+	if err := r.decryptSecrets(context.Background(), hash, objs, rendered); !errors.Is(err, ErrNoDecryption) {
+		t.Errorf("Expected an error without decryption got %v", err)
+	}
+	hash.Spec.Decryption = &v1.Decryption{SecretName: "slipway/sops-keys"}
+	if err := r.decryptSecrets(context.Background(), hash, objs, nil); !errors.Is(err, ErrNotRendered) {
+		t.Errorf("Expected an error without the rendered Secret got %v", err)
+	}
+	if err := r.decryptSecrets(context.Background(), hash, objs, rendered); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if password, _, _ := unstruct.NestedString(encrypted.Object, "data", "password"); password != "cGxhaW4=" {
+		t.Errorf("Expected the decrypted password got %s", password)
+	}
+	if _, ok := encrypted.Object["sops"]; ok {
+		t.Errorf("Expected the sops metadata to be removed")
+	}
+	if password, _, _ := unstruct.NestedString(plain.Object, "data", "password"); password == "cGxhaW4=" {
+		t.Errorf("Expected Secrets without sops metadata to be left alone")
+	}
+	if args, _ := ioutil.ReadFile(filepath.Join(dir, "args")); strings.Contains(string(args), "--ignore-mac") {
+		t.Errorf("Expected the MAC to be checked got %s", args)
+	}
+	if keyFile, _ := ioutil.ReadFile(filepath.Join(dir, "keyfile")); len(keyFile) == 0 {
+		t.Errorf("Expected an age key file")
+	} else if _, err := os.Stat(strings.TrimSpace(string(keyFile))); !os.IsNotExist(err) {
+		t.Errorf("Expected the age key file to be removed got %v", err)
+	}
+	hash.Spec.Decryption.IgnoreMAC = true
+	encrypted = encryptedSecret()
+	if err := r.decryptSecrets(context.Background(), hash, []*unstruct.Unstructured{encrypted}, rendered); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if args, _ := ioutil.ReadFile(filepath.Join(dir, "args")); !strings.Contains(string(args), "--ignore-mac") {
+		t.Errorf("Expected the MAC to be ignored got %s", args)
+	}
+	if loggedObject(encrypted) != "Kind:Secret Named:db in Namespace:" {
+		t.Errorf("Expected Secrets to be logged by name got %v", loggedObject(encrypted))
+	}
+
+	keys.Data = map[string][]byte{"other": []byte("x")}
+	r.Client = fake.NewFakeClientWithScheme(kscheme.Scheme, keys)
+	if err := r.decryptSecrets(context.Background(), hash, []*unstruct.Unstructured{encryptedSecret()}, rendered); !errors.Is(err, ErrNoDecryptionKeys) {
+		t.Errorf("Expected an error without keys got %v", err)
+	}
+}
+
+func TestDecryptTransformedSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manifests, _ := json.Marshal(encryptedSecret().Object)
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret.json"), manifests, 0644); err != nil {
+		t.Fatal(err)
+	}
+	keys := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "sops-keys", Namespace: "slipway"},
+		Data:       map[string][]byte{"app" + ageKeySuffix: []byte("AGE-SECRET-KEY-1\n")},
+	}
+	r := &HashReconciler{Client: fake.NewFakeClientWithScheme(kscheme.Scheme, keys), SopsBinary: fakeSops(t, dir)}
+	r.transformers, _ = r.loadTransformers(nil)
+	hash := &v1.Hash{}
+	hash.Name = "abc1234def5678"
+	hash.Spec.Decryption = &v1.Decryption{SecretName: "slipway/sops-keys"}
+	operation := v1.Operation{
+		Name:     "app",
+		Path:     dir,
+		Renderer: v1.RendererRaw,
+		Transformers: []v1.Transformer{
+			{Type: "labels", Key: "team", Value: "web"},
+			{Type: "prefix", Value: "preview"},
+		},
+	}
+	m, _, encrypted, err := r.build(context.Background(), ctrl.Log.WithName("test"), hash, nil, operation, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := decodeResources(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The namespace setScope adds is not covered by the MAC either
+	objs[0].SetNamespace("default")
+
+	// Decrypting the Secret as transformed fails like a real MAC check
+	transformed, _ := json.Marshal(objs[0].Object)
+	if err := r.decryptSecrets(context.Background(), hash, objs, []json.RawMessage{transformed}); err == nil {
+		t.Fatalf("Expected the fake sops to reject changed metadata")
+	}
+	if err := r.decryptSecrets(context.Background(), hash, objs, encrypted); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	u := objs[0]
+	if password, _, _ := unstruct.NestedString(u.Object, "data", "password"); password != "cGxhaW4=" {
+		t.Errorf("Expected the decrypted password got %s", password)
+	}
+	if u.GetName() != "preview-db" || u.GetNamespace() != "default" || u.GetLabels()["team"] != "web" {
+		t.Errorf("Expected the metadata set by transformers got %v", u.Object["metadata"])
+	}
+	if _, ok := u.Object["sops"]; ok {
+		t.Errorf("Expected the sops metadata to be removed")
+	}
+	// The resources kept for the store stay encrypted
+	if data := m.Resources()[0].Map()["data"].(map[string]interface{}); data["password"] == "cGxhaW4=" {
+		t.Errorf("Expected the rendered Secret to stay encrypted")
+	}
+}
@@ -69,6 +69,7 @@ type highestTagSpec struct {
 // +kubebuilder:rbac:groups=git.gitops.slipway.org,resources=gitrepos,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=git.gitops.slipway.org,resources=gitrepos/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
 func (r *GitRepoReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx := context.Background()
 	log := r.Log.WithValues("gitrepo", req.NamespacedName)
@@ -82,10 +83,10 @@ func (r *GitRepoReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	}
 	// Get the remote git repo
 	remote := getRemote(repo)
-	// Get the Auth key from ~/.ssh/id_rsa
-	auth, err := getSSHKeyAuth()
+	// Get the Auth from the Secret of the repo or ~/.ssh/id_rsa
+	auth, err := gitAuth(ctx, r.Client, repo.Spec.SecretName, repo.Spec.Uri)
 	if err != nil {
-		log.Error(err, "Unable to parse ssh key")
+		log.Error(err, "Unable to load git credentials")
 		return returnResult, nil
 	}
 	// Get all git references like git ls-remote
@@ -162,9 +163,14 @@ OPLOOP:
 							activeHashes[ref.Hash().String()] = val
 						} else {
 							spec := &gitv1.HashSpec{
-								GitRepo:    repo.ObjectMeta.Name,
-								Operations: []gitv1.Operation{op},
-								Store:      &repo.Spec.Store,
+								GitRepo:            repo.ObjectMeta.Name,
+								Uri:                repo.Spec.Uri,
+								Operations:         []gitv1.Operation{op},
+								Store:              &repo.Spec.Store,
+								SecretName:         repo.Spec.SecretName,
+								Decryption:         repo.Spec.Decryption,
+								ServiceAccountName: repo.Spec.ServiceAccountName,
+								Policy:             repo.Spec.Policy,
 							}
 							activeHashes[ref.Hash().String()] = spec
 						}
@@ -181,9 +187,14 @@ OPLOOP:
 				activeHashes[highestTag.Hash] = val
 			} else {
 				spec := &gitv1.HashSpec{
-					GitRepo:    repo.ObjectMeta.Name,
-					Operations: []gitv1.Operation{op},
-					Store:      &repo.Spec.Store,
+					GitRepo:            repo.ObjectMeta.Name,
+					Uri:                repo.Spec.Uri,
+					Operations:         []gitv1.Operation{op},
+					Store:              &repo.Spec.Store,
+					SecretName:         repo.Spec.SecretName,
+					Decryption:         repo.Spec.Decryption,
+					ServiceAccountName: repo.Spec.ServiceAccountName,
+					Policy:             repo.Spec.Policy,
 				}
 				activeHashes[highestTag.Hash] = spec
 			}
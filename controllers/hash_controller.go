@@ -17,26 +17,35 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"sort"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/go-logr/logr"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	unstruct "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/record"
 	ref "k8s.io/client-go/tools/reference"
 
 	"sigs.k8s.io/kustomize/api/builtins"
 	"sigs.k8s.io/kustomize/api/filesys"
 	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/resid"
+	"sigs.k8s.io/kustomize/api/resmap"
 	ktypes "sigs.k8s.io/kustomize/api/types"
 
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -49,22 +58,42 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	gitv1 "github.com/slipway-gitops/slipway/api/v1"
+	"github.com/slipway-gitops/slipway/pkg/gitfetch"
 	"github.com/slipway-gitops/slipway/pkg/objectstore"
+	"github.com/slipway-gitops/slipway/pkg/rendercache"
+	"github.com/slipway-gitops/slipway/pkg/transformer"
 )
 
 // HashReconciler reconciles a Hash object
 type HashReconciler struct {
 	client.Client
-	Log          logr.Logger
-	Scheme       *runtime.Scheme
-	PluginPath   string
+	Log        logr.Logger
+	Scheme     *runtime.Scheme
+	PluginPath string
+	// RenderCacheDir keeps rendered manifests on disk when set
+	RenderCacheDir string
+	// WorkspaceDir is where repositories are mirrored and checked out
+	WorkspaceDir string
+	// HelmBinary renders charts for the helm renderer
+	HelmBinary string
+	// SopsBinary decrypts SOPS encrypted Secrets
+	SopsBinary   string
 	recorder     record.EventRecorder
+	restMapper   meta.RESTMapper
+	config       *rest.Config
 	objectstores map[string]objectstore.ObjectStore
 	watcher      func(*unstruct.Unstructured, *gitv1.Hash) error
+	controller   controller.Controller
+	clustersMu   sync.Mutex
+	clusters     map[string]*cluster
+	renderCache  *rendercache.Cache
+	workspace    *gitfetch.Workspace
+	transformers map[string]transformer.Transformer
 }
 
 var (
 	ErrEmptyPath      = errors.New("No path set")
+	ErrStageFailed    = errors.New("Stage failed")
 	annotationsPlugin = &builtins.AnnotationsTransformerPlugin{
 		Annotations: make(map[string]string),
 		FieldSpecs: []ktypes.FieldSpec{
@@ -87,9 +116,23 @@ var (
 			ktypes.FieldSpec{
 				Path: "spec/containers/image",
 			},
+			ktypes.FieldSpec{
+				Path: "spec/initContainers/image",
+			},
 			ktypes.FieldSpec{
 				Path: "spec/template/spec/containers/image",
 			},
+			ktypes.FieldSpec{
+				Path: "spec/template/spec/initContainers/image",
+			},
+			ktypes.FieldSpec{
+				Gvk:  resid.Gvk{Kind: "CronJob"},
+				Path: "spec/jobTemplate/spec/template/spec/containers/image",
+			},
+			ktypes.FieldSpec{
+				Gvk:  resid.Gvk{Kind: "CronJob"},
+				Path: "spec/jobTemplate/spec/template/spec/initContainers/image",
+			},
 		},
 	}
 
@@ -124,6 +167,30 @@ var (
 			},
 		},
 	}
+	replicasPlugin = &builtins.ReplicaCountTransformerPlugin{
+		FieldSpecs: []ktypes.FieldSpec{
+			ktypes.FieldSpec{
+				Gvk:                resid.Gvk{Group: "apps", Kind: "Deployment"},
+				Path:               "spec/replicas",
+				CreateIfNotPresent: true,
+			},
+			ktypes.FieldSpec{
+				Gvk:                resid.Gvk{Group: "apps", Kind: "StatefulSet"},
+				Path:               "spec/replicas",
+				CreateIfNotPresent: true,
+			},
+			ktypes.FieldSpec{
+				Gvk:                resid.Gvk{Group: "apps", Kind: "ReplicaSet"},
+				Path:               "spec/replicas",
+				CreateIfNotPresent: true,
+			},
+			ktypes.FieldSpec{
+				Gvk:                resid.Gvk{Kind: "ReplicationController"},
+				Path:               "spec/replicas",
+				CreateIfNotPresent: true,
+			},
+		},
+	}
 )
 
 // +kubebuilder:rbac:groups=git.gitops.slipway.org,resources=hashes,verbs=get;list;watch;create;update;patch;delete
@@ -148,9 +215,25 @@ func (r *HashReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	var gitrepo gitv1.GitRepo
 	if err := r.Get(ctx, types.NamespacedName{Name: hash.Spec.GitRepo}, &gitrepo); err != nil {
 		log.Error(err, "unable to fetch Owner Repo", "repo", hash.Spec.GitRepo)
+		if !hash.ObjectMeta.DeletionTimestamp.IsZero() {
+			// Hooks cannot be rendered without the GitRepo, only clean up targets
+			return r.reconcileDelete(ctx, log, &hash, nil)
+		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	// Filesystem needed for Kustomize to make a call
+	fs := filesys.MakeFsOnDisk()
+
+	// Instantiate a kustomizer
+	opts := krusty.MakeDefaultOptions()
+	k := krusty.MakeKustomizer(fs, opts)
+
+	// Run the pre-delete hooks and clean up the targets of a deleted Hash
+	if !hash.ObjectMeta.DeletionTimestamp.IsZero() {
+		return r.reconcileDelete(ctx, log, &hash, k)
+	}
+
 	// If storage is set
 	// TODO: move this and the maps to the packages
 	var storage objectstore.ObjectStore
@@ -164,256 +247,606 @@ func (r *HashReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	} else {
 		log.Info("No Storage type selected")
 	}
-	// Filesystem needed for Kustomize to make a call
-	fs := filesys.MakeFsOnDisk()
 
-	// Instantiate a kustomizer
-	opts := krusty.MakeDefaultOptions()
-	k := krusty.MakeKustomizer(fs, opts)
-
-	// sort all the Operations in this Hash by weight
-	sort.Slice(hash.Spec.Operations, func(i, j int) bool {
-		return hash.Spec.Operations[i].Weight < hash.Spec.Operations[j].Weight
-	})
+	// Group the Operations in this Hash into stages by weight
+	stages := operationStages(hash.Spec.Operations)
 
 	// Save old objects and delete ones that are no longer present.
-	oldObjects := hash.Status.Objects
+	oldObjects := clusterObjects(&hash)
+	oldStages := previousStages(&hash)
+	oldOperations := hash.Status.Operations
 	// Status objects will be reset and be set at the end of reconciliation
 	hash.Status.Objects = nil
-
-	// Range over all the sorted operations
-	for _, operation := range hash.Spec.Operations {
-
-		if operation.Path == "" {
-			log.Error(ErrEmptyPath, "Invalid path", "operation", operation)
-			continue
-		}
-		// If HashSpec is set, set the reference to the end of the url
-		path := operation.Path
-		if operation.HashPath {
-			path = fmt.Sprintf("%v?ref=%v", path, hash.Name)
-		}
-
-		// Run Kustomize returns ResMap
-		// https://godoc.org/sigs.k8s.io/kustomize/api/resmap#ResMap
-		m, err := k.Run(path)
-		if err != nil {
-			log.Error(err, "unable to fetch kustomize manifests", "operation", operation)
-			return ctrl.Result{}, err
-		}
-
-		// Run all transformers against the ResMap
-		for _, t := range operation.Transformers {
-
-			// This sets the value for the "key":"value" for the transformer
-			var val string
-			switch t.Value {
-			case "branch", "pull", "tag":
-				val = operation.ReferenceTitle
-			case "hash":
-				val = hash.Name
-			default:
-				val = t.Value
-			}
-			var err error
-			switch t.Type {
-			case "annotations":
-				plugin := *annotationsPlugin
-				plugin.Annotations[t.Key] = val
-				err = plugin.Transform(m)
-			case "images":
-				plugin := *imagesPlugin
-				plugin.ImageTag.Name = t.Key
-				plugin.ImageTag.NewTag = val
-				err = plugin.Transform(m)
-			case "labels":
-				plugin := *labelsPlugin
-				plugin.Labels[t.Key] = val
-				err = plugin.Transform(m)
-			case "namespace":
-				plugin := *namespacePlugin
-				plugin.ObjectMeta.Namespace = val
-				err = plugin.Transform(m)
-				// Create or update a namespace,
-				// this will create or update later if already in the manifest
-				ns := corev1.Namespace{
-					ObjectMeta: metav1.ObjectMeta{Name: val},
-				}
-				// Take ownership
-				if err := controllerutil.SetControllerReference(
-					&hash,
-					&ns,
-					r.Scheme); err != nil {
-					log.Error(err,
-						"unable to create namespace for hash",
-						"hash",
-						hash,
-						"namespace",
-						ns)
-					return ctrl.Result{}, err
+	hash.Status.Targets = nil
+	hash.Status.Rejected = nil
+	hash.Status.Operations = nil
+	hash.Status.Stages = nil
+
+	// Apply each stage and only move on to the next weight when it is ready
+	result := ctrl.Result{}
+	complete := true
+	failed := false
+	needsFinalizer := false
+	for _, stage := range stages {
+		var applied []*unstruct.Unstructured
+		var rendered []*renderedOperation
+		health, message := gitv1.HealthHealthy, ""
+		for _, operation := range stage.Operations {
+			startOperation(&hash, operation, oldOperations)
+			op, err := r.renderOperation(ctx, log, &hash, k, operation)
+			if err != nil {
+				if r.failOperation(log, &hash, operation, err) {
+					failed = true
+					continue
 				}
-				// Creat or update the namespace
-				result, err := controllerutil.CreateOrUpdate(
-					context.TODO(),
-					r,
-					&ns,
-					func() error { return nil },
-				)
-				log.Info("Operation result", string(result), "Object for Hash", "object", ns)
-				r.recorder.Event(
-					&hash,
-					"Normal",
-					string(result),
-					fmt.Sprintf("%s Kind:%s Named:%s",
-						strings.Title(string(result)),
-						"Namespace",
-						val,
-					),
-				)
-				if err != nil {
-					log.Error(err, "unable to add namespace for transform",
-						"hash",
-						hash,
-						"namespace",
-						ns)
-					return ctrl.Result{}, err
+				return r.applyFailed(ctx, log, &hash, oldObjects, oldOperations, err)
+			}
+			if op == nil {
+				continue
+			}
+			operationStatus(&hash, operation.Name).Digest = op.Digest
+			operationStatus(&hash, operation.Name).Sanitized = sanitizedValues(&hash, operation)
+			r.recordRejected(&hash, op.Rejected)
+			needsFinalizer = needsFinalizer || op.hasHooks(gitv1.HookPreDelete)
+			// Pre-apply hooks have to succeed before the operation is applied
+			hookHealth, hookMsg, err := r.runHooks(ctx, log, &hash, op, gitv1.HookPreApply)
+			if err != nil {
+				if r.failOperation(log, &hash, operation, err) {
+					failed = true
+					continue
 				}
-
-				// add the reference to the status
-				if objRef, err := ref.GetReference(
-					r.Scheme,
-					&ns); err != nil {
-					log.Error(err,
-						"unable to make reference to active objects",
-						"object",
-						ns)
-				} else {
-					hash.Status.Objects = append(hash.Status.Objects, *objRef)
+				return r.applyFailed(ctx, log, &hash, oldObjects, oldOperations, err)
+			}
+			if hookHealth != gitv1.HealthHealthy {
+				health, message = hookHealth, hookMsg
+				break
+			}
+			// Objects in remote clusters are not garbage collected
+			if op.Cluster.Key != "" {
+				if err := r.addFinalizer(ctx, &hash, TargetFinalizer); err != nil {
+					log.Error(err, "unable to add finalizer for targets")
+					return r.applyFailed(ctx, log, &hash, oldObjects, oldOperations, err)
 				}
-			case "prefix":
-				plugin := *prefixSuffixPlugin
-				plugin.Prefix = fmt.Sprintf("%s-", val)
-				err = plugin.Transform(m)
-			case "suffix":
-				plugin := *prefixSuffixPlugin
-				plugin.Suffix = fmt.Sprintf("-%s", val)
-				err = plugin.Transform(m)
 			}
-			// run the transformer against the ResMap
+			start := len(objectReferences(&hash, op.Cluster.Key))
+			objs, pending, err := r.applyOperation(ctx, log, &hash, storage, op)
 			if err != nil {
-				log.Error(err, "unable to transform")
-				return ctrl.Result{}, err
+				if r.failOperation(log, &hash, operation, err) {
+					failed = true
+					continue
+				}
+				return r.applyFailed(ctx, log, &hash, oldObjects, oldOperations, err)
 			}
-		}
-
-		//  Loop through all the kustomize objects from the ResMap
-		res := m.Resources()
-		for _, v := range res {
-			// move it to Yaml and decode to kuberentes unstructured objects
-			decode := yaml.NewYAMLOrJSONDecoder(strings.NewReader(v.String()), 10)
-			var u unstruct.Unstructured
-			err = decode.Decode(&u)
-			if err != nil {
-				log.Error(err, "unable to decode kustomize manifests")
-				return ctrl.Result{}, client.IgnoreNotFound(err)
+			applied = append(applied, objs...)
+			rendered = append(rendered, op)
+			refs := append([]corev1.ObjectReference(nil), objectReferences(&hash, op.Cluster.Key)[start:]...)
+			if pending != "" {
+				operationStatus(&hash, operation.Name).Objects = refs
+				health, message = gitv1.HealthProgressing, pending
+				break
 			}
-			// unstructured namespaced objects just through an error with namespace empty
-			if u.GetNamespace() == "" {
-				u.SetNamespace("default")
+			operationApplied(operationStatus(&hash, operation.Name), refs, metav1.Now())
+		}
+		if health == gitv1.HealthHealthy {
+			health, message = objectsHealth(applied)
+		}
+		// Post-apply hooks run once everything in the stage is ready
+		for _, op := range rendered {
+			if health != gitv1.HealthHealthy {
+				break
 			}
-			// Take ownership of the resource
-			if err := controllerutil.SetControllerReference(&hash, &u, r.Scheme); err != nil {
-				log.Error(err, "unable to create resource for hash", "hash", hash)
-				return ctrl.Result{}, err
+			hookHealth, hookMsg, err := r.runHooks(ctx, log, &hash, op, gitv1.HookPostApply)
+			if err != nil {
+				if r.failOperation(log, &hash, op.Operation, err) {
+					failed = true
+					continue
+				}
+				return r.applyFailed(ctx, log, &hash, oldObjects, oldOperations, err)
 			}
-			// Create or Update
-			result, err := controllerutil.CreateOrUpdate(
-				context.TODO(),
-				r,
-				&u,
-				func() error { return nil },
-			)
+			health, message = hookHealth, hookMsg
+		}
+		status := newStageStatus(stage, oldStages, health, message, metav1.Now())
+		hash.Status.Stages = append(hash.Status.Stages, status)
+		if status.Phase == gitv1.StageReady {
+			continue
+		}
+		complete = false
+		if status.Phase == gitv1.StageFailed {
+			log.Error(ErrStageFailed, status.Message, "weight", stage.Weight)
 			r.recorder.Event(
 				&hash,
-				"Normal",
-				string(result),
-				fmt.Sprintf("%s Kind:%s Named:%s in Namespace:%s",
-					strings.Title(string(result)),
-					u.GetKind(),
-					u.GetName(),
-					u.GetNamespace(),
-				),
+				"Warning",
+				"StageFailed",
+				fmt.Sprintf("Stage weight:%d %s", stage.Weight, status.Message),
 			)
-			// Catch specific errors for CreateOrUpdate
-			if err != nil {
-				log.Error(err, "unable to create object for hash", "object", u)
-				return ctrl.Result{}, err
-			}
-			if err := r.watcher(&u, &hash); err != nil {
-				log.Error(err, "unable to set watch on object", "object", u, "hash", hash)
+		} else {
+			log.Info("Waiting on stage", "weight", stage.Weight, "message", status.Message)
+			result = ctrl.Result{RequeueAfter: stageRequeue}
+		}
+		break
+	}
+	keepOperations(&hash, oldOperations)
+	// Failed operations that let the others continue are retried
+	if failed {
+		result = ctrl.Result{RequeueAfter: stageRequeue}
+	}
 
+	// Later stages were not applied, keep their objects until they are
+	if !complete {
+		mergeClusterObjects(&hash, oldObjects)
+	}
+	// Reap Old references
+	for key, objs := range oldObjects {
+		current := objectReferences(&hash, key)
+		var c *cluster
+		for _, oobj := range objs {
+			if containsObjectReference(current, oobj) {
+				continue
 			}
-			log.Info("Operation result", string(result), "Object for Hash", "object", u)
-
-			// Safe the reference in status
-			objRef, err := ref.GetReference(r.Scheme, &u)
+			if c == nil {
+				var err error
+				if c, err = r.clusterForKey(ctx, log, &hash, key); err != nil {
+					log.Error(err, "unable to reach target to delete orphaned objects", "target", key)
+					break
+				}
+			}
+			u := &unstructured.Unstructured{}
+			u.SetName(oobj.Name)
+			u.SetNamespace(oobj.Namespace)
+			u.SetGroupVersionKind(oobj.GroupVersionKind())
+			err := c.Delete(ctx, u)
 			if err != nil {
-				log.Error(err, "unable to make reference to active objects", "object", u)
+				log.Error(err, "unable to delete orphaned objects", "object", u)
 			} else {
-				hash.Status.Objects = append(hash.Status.Objects, *objRef)
+				r.recorder.Event(
+					&hash,
+					"Normal",
+					"delete",
+					fmt.Sprintf("%s Kind:%s Named:%s in Namespace:%s",
+						"Deleted",
+						u.GetKind(),
+						u.GetName(),
+						u.GetNamespace(),
+					),
+				)
+				log.Info("Operation result", "delete", "Object for Hash", "object", u)
 			}
-			log.Info("object for Hash", "object", u)
+		}
+	}
+	// Hold the Hash on deletion until its pre-delete hooks ran
+	if needsFinalizer {
+		if err := r.addFinalizer(ctx, &hash, HookFinalizer); err != nil {
+			log.Error(err, "unable to add finalizer for pre-delete hooks")
+			return ctrl.Result{}, err
+		}
+	}
+	// Assess the health of everything the Hash owns
+	health, reason, message := r.assessHealth(ctx, &hash)
+	setHealth(&hash, health, reason, message, metav1.Now())
+	if err := r.Status().Update(ctx, &hash); err != nil {
+		log.Error(err, "unable to update Hash status")
+	}
+	return result, nil
+}
 
+// renderedOperation is an operation rendered into the objects to apply.
+type renderedOperation struct {
+	Operation gitv1.Operation
+	// Resources as rendered by kustomize and the transformers
+	Resources resmap.ResMap
+	// Namespaces targeted by namespace transformers and the operation
+	Namespaces []string
+	// Cluster the operation is applied to
+	Cluster *cluster
+	// Objects to apply, in apply order
+	Objects []*unstruct.Unstructured
+	// Kinds defined by CustomResourceDefinitions in the operation
+	Kinds map[schema.GroupKind]*unstruct.Unstructured
+	// Hooks to run as Jobs
+	Hooks []hook
+	// Objects rejected by the policy
+	Rejected []gitv1.RejectedObject
+	// Digest of the rendered manifests
+	Digest string
+}
+
+// hasHooks reports if the operation has hooks of the type.
+func (op *renderedOperation) hasHooks(hookType gitv1.HookType) bool {
+	for _, h := range op.Hooks {
+		if h.is(hookType) {
+			return true
 		}
-		yaml, err := m.AsYaml()
+	}
+	return false
+}
+
+// renderOperation renders an operation into the objects to apply.
+// Operations without a path are skipped and return nil.
+func (r *HashReconciler) renderOperation(
+	ctx context.Context,
+	log logr.Logger,
+	hash *gitv1.Hash,
+	k *krusty.Kustomizer,
+	operation gitv1.Operation,
+) (*renderedOperation, error) {
+	if operation.Path == "" {
+		log.Error(ErrEmptyPath, "Invalid path", "operation", operation)
+		return nil, nil
+	}
+	m, namespaces, encrypted, err := r.render(ctx, log, hash, k, operation)
+	if err != nil {
+		return nil, err
+	}
+	c, err := r.clusterFor(ctx, log, hash, operation.Target)
+	if err != nil {
+		log.Error(err, "unable to connect to target", "operation", operation)
+		return nil, err
+	}
+	rendered := &renderedOperation{
+		Operation:  operation,
+		Resources:  m,
+		Namespaces: operationNamespaces(operation, namespaces),
+		Cluster:    c,
+	}
+
+	objs, err := decodeResources(m)
+	if err != nil {
+		log.Error(err, "unable to decode kustomize manifests")
+		return nil, err
+	}
+	// Only namespaced objects belong in the namespace of the operation
+	rendered.Kinds = definedKinds(objs)
+	for _, u := range objs {
+		if err := setScope(c.mapper, rendered.Kinds, u, operation.Namespace); err != nil {
+			log.Error(err, "unable to determine scope", "object", u)
+			return nil, err
+		}
+	}
+	// Objects the policy does not allow are never applied
+	var allowed []*unstruct.Unstructured
+	for _, u := range objs {
+		if message := policyViolation(hash.Spec.Policy, u); message != "" {
+			rendered.Rejected = append(rendered.Rejected, rejectedObject(operation.Name, u, message))
+			continue
+		}
+		allowed = append(allowed, u)
+	}
+	var allowedNamespaces []string
+	for _, val := range rendered.Namespaces {
+		ns := &unstruct.Unstructured{}
+		ns.SetAPIVersion("v1")
+		ns.SetKind("Namespace")
+		ns.SetName(val)
+		if message := policyViolation(hash.Spec.Policy, ns); message != "" {
+			rendered.Rejected = append(rendered.Rejected, rejectedObject(operation.Name, ns, message))
+			continue
+		}
+		allowedNamespaces = append(allowedNamespaces, val)
+	}
+	rendered.Namespaces = allowedNamespaces
+	// Only the objects are decrypted, the resources kept for the store stay encrypted
+	if err := r.decryptSecrets(ctx, hash, allowed, encrypted); err != nil {
+		log.Error(err, "unable to decrypt secrets", "operation", operation)
+		return nil, err
+	}
+	rendered.Hooks, rendered.Objects, err = splitHooks(allowed)
+	if err != nil {
+		log.Error(err, "unable to load hooks", "operation", operation)
+		return nil, err
+	}
+	sortObjects(rendered.Objects)
+	if rendered.Digest, err = renderDigest(m); err != nil {
+		log.Error(err, "unable to produce yaml from resourcemap", "resourcemap", m)
+		return nil, err
+	}
+	return rendered, nil
+}
+
+// build renders an operation with its renderer and runs the transformers,
+// returning the namespaces targeted by namespace transformers and the
+// encrypted Secrets as rendered. A remote path is checked out at commit when
+// it is set.
+func (r *HashReconciler) build(
+	ctx context.Context,
+	log logr.Logger,
+	hash *gitv1.Hash,
+	k *krusty.Kustomizer,
+	operation gitv1.Operation,
+	commit string,
+) (m resmap.ResMap, namespaces []string, encrypted []json.RawMessage, err error) {
+	path := operationPath(hash, operation)
+	root := path
+	// Remote paths are checked out with the credentials of the GitRepo, at
+	// the commit resolved for the render cache when it is set
+	remote, ok := gitfetch.Parse(path)
+	if commit != "" {
+		remote.Ref = commit
+	}
+	if ok && r.workspace != nil {
+		auth, err := gitAuth(ctx, r.Client, hash.Spec.SecretName, remote.Repo)
 		if err != nil {
-			log.Error(err, "unable to produce yaml from resourcemap", "resourcemap", m)
+			log.Error(err, "unable to load git credentials", "operation", operation)
+			return nil, nil, nil, err
 		}
-		if storage != nil {
-			go func(hash, op string, bytes []byte) {
-				err = storage.Save(hash, op, bytes)
-				if err != nil {
-					log.Error(err, "unable to save yaml to storage", "yaml", yaml)
-				}
-			}(hash.Name, operation.Name, yaml)
+		checkout, err := r.workspace.Checkout(ctx, remote, hash.Spec.SecretName, auth)
+		if err != nil {
+			log.Error(err, "unable to fetch operation path", "operation", operation)
+			return nil, nil, nil, err
+		}
+		defer checkout.Close()
+		path, root = checkout.Path, checkout.Root
+	} else if !ok {
+		if err := validateLocal(operation); err != nil {
+			log.Error(err, "invalid options for a local path", "operation", operation)
+			return nil, nil, nil, err
 		}
 	}
-	// Reap Old references
-OLDOBJECTLOOP:
-	for _, oobj := range oldObjects {
-		for _, nobj := range hash.Status.Objects {
-			if nobj.Kind == oobj.Kind &&
-				nobj.Name == oobj.Name &&
-				nobj.Namespace == oobj.Namespace {
-				continue OLDOBJECTLOOP
+
+	m, err = r.renderSource(ctx, k, hash, operation, path, root)
+	if err != nil {
+		log.Error(err, "unable to render manifests", "operation", operation)
+		return nil, nil, nil, err
+	}
+	// The MAC of encrypted Secrets covers the metadata transformers change
+	if encrypted, err = encryptedSecrets(m); err != nil {
+		log.Error(err, "unable to decode rendered manifests", "operation", operation)
+		return nil, nil, nil, err
+	}
+
+	// Run all transformers against the ResMap
+	for _, t := range operation.Transformers {
+
+		// This sets the value for the "key":"value" for the transformer
+		val, err := transformerValue(hash, operation, t.Value)
+		if err != nil {
+			log.Error(err, "unable to template transformer value", "value", t.Value)
+			return nil, nil, nil, err
+		}
+		val, _ = sanitizeValue(t, val)
+		tr, ok := r.transformers[t.Type]
+		if !ok {
+			err = fmt.Errorf("%w: %s", transformer.ErrInvalidType, t.Type)
+			log.Error(err, "unable to transform")
+			return nil, nil, nil, err
+		}
+		tr, err = tr.New(ctx, t, transformer.Reference{Hash: hash, Operation: operation, Value: val})
+		if err == nil {
+			err = tr.Transform(m)
+		}
+		if t.Type == "namespace" {
+			namespaces = append(namespaces, val)
+		}
+		// run the transformer against the ResMap
+		if err != nil {
+			log.Error(err, "unable to transform")
+			return nil, nil, nil, err
+		}
+	}
+	return m, namespaces, encrypted, nil
+}
+
+// decodeResources converts the resources of a ResMap to unstructured objects.
+func decodeResources(m resmap.ResMap) ([]*unstruct.Unstructured, error) {
+	var objs []*unstruct.Unstructured
+	for _, v := range m.Resources() {
+		// move it to Yaml and decode to kuberentes unstructured objects
+		decode := yaml.NewYAMLOrJSONDecoder(strings.NewReader(v.String()), 10)
+		u := &unstruct.Unstructured{}
+		if err := decode.Decode(u); err != nil {
+			return nil, err
+		}
+		objs = append(objs, u)
+	}
+	return objs, nil
+}
+
+// applyOperation creates or updates the namespaces and objects of a rendered
+// operation in apply order, returning the objects that were applied.
+// Custom resources whose kind is not served yet stop the apply, what is waited
+// on is returned as pending.
+func (r *HashReconciler) applyOperation(
+	ctx context.Context,
+	log logr.Logger,
+	hash *gitv1.Hash,
+	storage objectstore.ObjectStore,
+	op *renderedOperation,
+) (applied []*unstruct.Unstructured, pending string, err error) {
+	// Namespaces targeted by namespace transformers
+	for _, val := range op.Namespaces {
+		if err := r.ensureNamespace(log, hash, op.Cluster, val); err != nil {
+			return nil, "", err
+		}
+	}
+
+	//  Loop through all the rendered objects
+	served := make(map[schema.GroupKind]bool)
+	for _, u := range op.Objects {
+		// Wait on the CustomResourceDefinitions of the operation
+		gk := u.GroupVersionKind().GroupKind()
+		if crd, ok := op.Kinds[gk]; ok && !served[gk] {
+			pending, err := r.kindPending(ctx, op.Cluster, crd, u.GroupVersionKind())
+			if err != nil {
+				log.Error(err, "unable to check custom resource kind", "object", loggedObject(u))
+				return applied, "", err
 			}
+			if pending != "" {
+				log.Info("Waiting on custom resource kind", "object", loggedObject(u), "message", pending)
+				return applied, pending, nil
+			}
+			served[gk] = true
+		}
+		// Take ownership of the resource
+		if err := op.Cluster.own(hash, u, r.Scheme); err != nil {
+			log.Error(err, "unable to create resource for hash", "hash", hash)
+			return applied, "", err
 		}
-		u := &unstructured.Unstructured{}
-		u.SetName(oobj.Name)
-		u.SetNamespace(oobj.Namespace)
-		u.SetGroupVersionKind(oobj.GroupVersionKind())
-		err := r.Delete(ctx, u)
+		// Create or Update
+		result, err := controllerutil.CreateOrUpdate(
+			context.TODO(),
+			op.Cluster,
+			u,
+			func() error { return nil },
+		)
+		r.recorder.Event(
+			hash,
+			"Normal",
+			string(result),
+			fmt.Sprintf("%s Kind:%s Named:%s in Namespace:%s",
+				strings.Title(string(result)),
+				u.GetKind(),
+				u.GetName(),
+				u.GetNamespace(),
+			),
+		)
+		// Catch specific errors for CreateOrUpdate
 		if err != nil {
-			log.Error(err, "unable to delete orphaned objects", "object", u)
+			log.Error(err, "unable to create object for hash", "object", loggedObject(u))
+			return applied, "", err
+		}
+		if err := op.Cluster.watch(u, hash); err != nil {
+			log.Error(err, "unable to set watch on object", "object", loggedObject(u), "hash", hash)
+
+		}
+		log.Info("Operation result", string(result), "Object for Hash", "object", loggedObject(u))
+
+		// Safe the reference in status
+		objRef, err := ref.GetReference(r.Scheme, u)
+		if err != nil {
+			log.Error(err, "unable to make reference to active objects", "object", loggedObject(u))
 		} else {
-			r.recorder.Event(
-				&hash,
-				"Normal",
-				"delete",
-				fmt.Sprintf("%s Kind:%s Named:%s in Namespace:%s",
-					"Deleted",
-					u.GetKind(),
-					u.GetName(),
-					u.GetNamespace(),
-				),
-			)
-			log.Info("Operation result", "delete", "Object for Hash", "object", u)
+			addObjectReference(hash, op.Cluster.Key, *objRef)
 		}
+		applied = append(applied, u)
+		log.Info("object for Hash", "object", loggedObject(u))
+
 	}
-	if err := r.Status().Update(ctx, &hash); err != nil {
+	yaml, err := op.Resources.AsYaml()
+	if err != nil {
+		log.Error(err, "unable to produce yaml from resourcemap", "resourcemap", op.Resources)
+	}
+	if storage != nil {
+		go func(hash, op string, bytes []byte) {
+			err = storage.Save(hash, op, bytes)
+			if err != nil {
+				log.Error(err, "unable to save yaml to storage", "yaml", yaml)
+			}
+		}(hash.Name, op.Operation.Name, yaml)
+	}
+
+	return applied, "", nil
+}
+
+// operationNamespaces adds the namespace of the operation to the namespaces
+// targeted by its transformers so it exists before the objects are applied.
+// The default namespace always exists and is never owned.
+func operationNamespaces(operation gitv1.Operation, namespaces []string) []string {
+	if operation.Namespace == "" || operation.Namespace == metav1.NamespaceDefault {
+		return namespaces
+	}
+	for _, val := range namespaces {
+		if val == operation.Namespace {
+			return namespaces
+		}
+	}
+	return append(namespaces, operation.Namespace)
+}
+
+// ensureNamespace creates or updates a namespace targeted by a namespace
+// transformer, this will create or update later if already in the manifest.
+func (r *HashReconciler) ensureNamespace(log logr.Logger, hash *gitv1.Hash, c *cluster, val string) error {
+	ns := &unstruct.Unstructured{}
+	ns.SetAPIVersion("v1")
+	ns.SetKind("Namespace")
+	ns.SetName(val)
+	// Take ownership
+	if err := c.own(
+		hash,
+		ns,
+		r.Scheme); err != nil {
+		log.Error(err,
+			"unable to create namespace for hash",
+			"hash",
+			hash,
+			"namespace",
+			ns)
+		return err
+	}
+	// Creat or update the namespace
+	result, err := controllerutil.CreateOrUpdate(
+		context.TODO(),
+		c,
+		ns,
+		func() error { return nil },
+	)
+	log.Info("Operation result", string(result), "Object for Hash", "object", ns)
+	r.recorder.Event(
+		hash,
+		"Normal",
+		string(result),
+		fmt.Sprintf("%s Kind:%s Named:%s",
+			strings.Title(string(result)),
+			"Namespace",
+			val,
+		),
+	)
+	if err != nil {
+		log.Error(err, "unable to add namespace for transform",
+			"hash",
+			hash,
+			"namespace",
+			ns)
+		return err
+	}
+
+	// add the reference to the status
+	if objRef, err := ref.GetReference(
+		r.Scheme,
+		ns); err != nil {
+		log.Error(err,
+			"unable to make reference to active objects",
+			"object",
+			ns)
+	} else {
+		addObjectReference(hash, c.Key, *objRef)
+	}
+	return nil
+}
+
+// applyError returns the reason and message of a failed apply. Missing
+// permissions of the impersonated ServiceAccount get the Forbidden reason,
+// other errors the given reason.
+func applyError(hash *gitv1.Hash, err error, reason string) (string, string) {
+	if !apierrors.IsForbidden(err) {
+		return reason, err.Error()
+	}
+	if hash.Spec.ServiceAccountName != "" {
+		return "Forbidden", fmt.Sprintf("ServiceAccount %s: %s", hash.Spec.ServiceAccountName, err)
+	}
+	return "Forbidden", err.Error()
+}
+
+// applyFailed records a failed apply in the Hash status, keeping the objects
+// it already owned so they are not reaped. Forbidden errors are reported with
+// the Forbidden reason on the conditions.
+func (r *HashReconciler) applyFailed(
+	ctx context.Context,
+	log logr.Logger,
+	hash *gitv1.Hash,
+	oldObjects map[string][]corev1.ObjectReference,
+	oldOperations []gitv1.OperationStatus,
+	err error,
+) (ctrl.Result, error) {
+	mergeClusterObjects(hash, oldObjects)
+	keepOperations(hash, oldOperations)
+	reason, message := applyError(hash, err, "ApplyFailed")
+	if reason == "Forbidden" {
+		r.recorder.Event(hash, "Warning", reason, message)
+	}
+	setHealth(hash, gitv1.HealthDegraded, reason, message, metav1.Now())
+	if err := r.Status().Update(ctx, hash); err != nil {
 		log.Error(err, "unable to update Hash status")
 	}
-	return ctrl.Result{}, nil
+	return ctrl.Result{}, err
 }
 
 func (r *HashReconciler) SetupWithManager(mgr ctrl.Manager) (err error) {
@@ -421,14 +854,41 @@ func (r *HashReconciler) SetupWithManager(mgr ctrl.Manager) (err error) {
 	if err != nil {
 		return err
 	}
+	plugins, err := transformer.LoadTransformers(fmt.Sprintf("%s/transformers/", r.PluginPath))
+	if err != nil {
+		return err
+	}
+	if r.transformers, err = r.loadTransformers(plugins); err != nil {
+		return err
+	}
 
 	r.recorder = mgr.GetEventRecorderFor("hash-controller")
+	r.restMapper = mgr.GetRESTMapper()
+	r.config = mgr.GetConfig()
+	r.renderCache, err = rendercache.New(renderCacheSize, renderCacheDiskSize, r.RenderCacheDir)
+	if err != nil {
+		return err
+	}
+	if r.HelmBinary == "" {
+		r.HelmBinary = "helm"
+	}
+	if r.SopsBinary == "" {
+		r.SopsBinary = "sops"
+	}
+	if r.WorkspaceDir == "" {
+		r.WorkspaceDir = filepath.Join(os.TempDir(), "slipway")
+	}
+	r.workspace, err = gitfetch.New(r.WorkspaceDir)
+	if err != nil {
+		return err
+	}
 
 	cntrl, err := ctrl.NewControllerManagedBy(mgr).
 		For(&gitv1.Hash{}).
 		WithEventFilter(predicate.GenerationChangedPredicate{}).
 		Build(r)
 	r.watcher = watcher(cntrl)
+	r.controller = cntrl
 	return err
 }
 
@@ -0,0 +1,272 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	unstruct "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	gitv1 "github.com/slipway-gitops/slipway/api/v1"
+)
+
+// objectHealth assesses an object the way kstatus does.
+// Core workloads, Jobs, Pods, PersistentVolumeClaims, LoadBalancer Services and
+// CustomResourceDefinitions have specific rules, anything else is judged by the
+// standard Ready, Reconciling and Stalled conditions in status.conditions.
+// The message describes what is pending or broken.
+func objectHealth(u *unstruct.Unstructured) (gitv1.HealthStatus, string) {
+	switch u.GroupVersionKind().GroupKind().String() {
+	case "Deployment.apps":
+		return deploymentHealth(u)
+	case "StatefulSet.apps":
+		return statefulSetHealth(u)
+	case "DaemonSet.apps":
+		return daemonSetHealth(u)
+	case "ReplicaSet.apps":
+		return replicaSetHealth(u)
+	case "Job.batch":
+		return jobHealth(u)
+	case "Pod":
+		return podHealth(u)
+	case "PersistentVolumeClaim":
+		return pvcHealth(u)
+	case "Service":
+		return serviceHealth(u)
+	case "CustomResourceDefinition.apiextensions.k8s.io":
+		return crdHealth(u)
+	}
+	return genericHealth(u)
+}
+
+func deploymentHealth(u *unstruct.Unstructured) (gitv1.HealthStatus, string) {
+	if !generationObserved(u) {
+		return gitv1.HealthProgressing, "rollout not observed"
+	}
+	if reason, _ := conditionReason(u, "Progressing"); reason == "ProgressDeadlineExceeded" {
+		return gitv1.HealthDegraded, "progress deadline exceeded"
+	}
+	replicas := specReplicas(u)
+	updated := statusInt(u, "updatedReplicas")
+	current := statusInt(u, "replicas")
+	available := statusInt(u, "availableReplicas")
+	switch {
+	case updated < replicas:
+		return gitv1.HealthProgressing, fmt.Sprintf("%d of %d replicas updated", updated, replicas)
+	case current > updated:
+		return gitv1.HealthProgressing, fmt.Sprintf("%d old replicas pending termination", current-updated)
+	case available < replicas:
+		return gitv1.HealthProgressing, fmt.Sprintf("%d of %d replicas available", available, replicas)
+	}
+	return gitv1.HealthHealthy, ""
+}
+
+func statefulSetHealth(u *unstruct.Unstructured) (gitv1.HealthStatus, string) {
+	if !generationObserved(u) {
+		return gitv1.HealthProgressing, "rollout not observed"
+	}
+	replicas := specReplicas(u)
+	ready := statusInt(u, "readyReplicas")
+	if ready < replicas {
+		return gitv1.HealthProgressing, fmt.Sprintf("%d of %d replicas ready", ready, replicas)
+	}
+	strategy, _, _ := unstruct.NestedString(u.Object, "spec", "updateStrategy", "type")
+	currentRevision, _, _ := unstruct.NestedString(u.Object, "status", "currentRevision")
+	updateRevision, _, _ := unstruct.NestedString(u.Object, "status", "updateRevision")
+	if strategy != "OnDelete" && updateRevision != "" && currentRevision != updateRevision {
+		return gitv1.HealthProgressing, fmt.Sprintf("revision %s not rolled out", updateRevision)
+	}
+	return gitv1.HealthHealthy, ""
+}
+
+func daemonSetHealth(u *unstruct.Unstructured) (gitv1.HealthStatus, string) {
+	if !generationObserved(u) {
+		return gitv1.HealthProgressing, "rollout not observed"
+	}
+	desired := statusInt(u, "desiredNumberScheduled")
+	updated := statusInt(u, "updatedNumberScheduled")
+	available := statusInt(u, "numberAvailable")
+	switch {
+	case updated < desired:
+		return gitv1.HealthProgressing, fmt.Sprintf("%d of %d pods updated", updated, desired)
+	case available < desired:
+		return gitv1.HealthProgressing, fmt.Sprintf("%d of %d pods available", available, desired)
+	}
+	return gitv1.HealthHealthy, ""
+}
+
+func replicaSetHealth(u *unstruct.Unstructured) (gitv1.HealthStatus, string) {
+	if !generationObserved(u) {
+		return gitv1.HealthProgressing, "rollout not observed"
+	}
+	if conditionStatus(u, "ReplicaFailure") == "True" {
+		_, message := conditionReason(u, "ReplicaFailure")
+		return gitv1.HealthDegraded, message
+	}
+	replicas := specReplicas(u)
+	available := statusInt(u, "availableReplicas")
+	if available < replicas {
+		return gitv1.HealthProgressing, fmt.Sprintf("%d of %d replicas available", available, replicas)
+	}
+	return gitv1.HealthHealthy, ""
+}
+
+func jobHealth(u *unstruct.Unstructured) (gitv1.HealthStatus, string) {
+	if conditionStatus(u, "Failed") == "True" {
+		_, message := conditionReason(u, "Failed")
+		return gitv1.HealthDegraded, fmt.Sprintf("job failed %s", message)
+	}
+	if conditionStatus(u, "Complete") == "True" {
+		return gitv1.HealthHealthy, ""
+	}
+	return gitv1.HealthProgressing, "job not complete"
+}
+
+func podHealth(u *unstruct.Unstructured) (gitv1.HealthStatus, string) {
+	phase, _, _ := unstruct.NestedString(u.Object, "status", "phase")
+	switch phase {
+	case "Succeeded":
+		return gitv1.HealthHealthy, ""
+	case "Failed":
+		return gitv1.HealthDegraded, "pod failed"
+	case "Running":
+		if conditionStatus(u, "Ready") == "True" {
+			return gitv1.HealthHealthy, ""
+		}
+		return gitv1.HealthProgressing, "pod not ready"
+	}
+	return gitv1.HealthProgressing, fmt.Sprintf("pod %s", phase)
+}
+
+func pvcHealth(u *unstruct.Unstructured) (gitv1.HealthStatus, string) {
+	phase, _, _ := unstruct.NestedString(u.Object, "status", "phase")
+	switch phase {
+	case "Bound":
+		return gitv1.HealthHealthy, ""
+	case "Lost":
+		return gitv1.HealthDegraded, "claim lost"
+	}
+	return gitv1.HealthProgressing, "claim not bound"
+}
+
+func serviceHealth(u *unstruct.Unstructured) (gitv1.HealthStatus, string) {
+	serviceType, _, _ := unstruct.NestedString(u.Object, "spec", "type")
+	if serviceType != "LoadBalancer" {
+		return gitv1.HealthHealthy, ""
+	}
+	ingress, _, _ := unstruct.NestedSlice(u.Object, "status", "loadBalancer", "ingress")
+	if len(ingress) == 0 {
+		return gitv1.HealthProgressing, "load balancer not provisioned"
+	}
+	return gitv1.HealthHealthy, ""
+}
+
+func crdHealth(u *unstruct.Unstructured) (gitv1.HealthStatus, string) {
+	if conditionStatus(u, "NamesAccepted") == "False" {
+		_, message := conditionReason(u, "NamesAccepted")
+		return gitv1.HealthDegraded, message
+	}
+	if conditionStatus(u, "Established") == "True" {
+		return gitv1.HealthHealthy, ""
+	}
+	return gitv1.HealthProgressing, "not established"
+}
+
+func genericHealth(u *unstruct.Unstructured) (gitv1.HealthStatus, string) {
+	if _, found, _ := unstruct.NestedInt64(u.Object, "status", "observedGeneration"); found && !generationObserved(u) {
+		return gitv1.HealthProgressing, "generation not observed"
+	}
+	if conditionStatus(u, "Stalled") == "True" {
+		_, message := conditionReason(u, "Stalled")
+		return gitv1.HealthDegraded, message
+	}
+	if conditionStatus(u, "Reconciling") == "True" {
+		_, message := conditionReason(u, "Reconciling")
+		return gitv1.HealthProgressing, message
+	}
+	if conditionStatus(u, "Ready") == "False" {
+		_, message := conditionReason(u, "Ready")
+		return gitv1.HealthProgressing, message
+	}
+	return gitv1.HealthHealthy, ""
+}
+
+// worseHealth returns the least healthy of two health statuses.
+func worseHealth(a, b gitv1.HealthStatus) gitv1.HealthStatus {
+	rank := map[gitv1.HealthStatus]int{
+		gitv1.HealthHealthy:     0,
+		gitv1.HealthProgressing: 1,
+		gitv1.HealthDegraded:    2,
+	}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// generationObserved reports if the controller of an object has seen its latest spec.
+func generationObserved(u *unstruct.Unstructured) bool {
+	observed, found, _ := unstruct.NestedInt64(u.Object, "status", "observedGeneration")
+	return found && observed >= u.GetGeneration()
+}
+
+// specReplicas returns the desired replicas, kubernetes defaults it to 1.
+func specReplicas(u *unstruct.Unstructured) int64 {
+	replicas, found, _ := unstruct.NestedInt64(u.Object, "spec", "replicas")
+	if !found {
+		return 1
+	}
+	return replicas
+}
+
+// statusInt returns an integer field from status, missing fields are 0.
+func statusInt(u *unstruct.Unstructured, field string) int64 {
+	val, _, _ := unstruct.NestedInt64(u.Object, "status", field)
+	return val
+}
+
+// conditionStatus returns the status of the condition type in status.conditions.
+func conditionStatus(u *unstruct.Unstructured, conditionType string) string {
+	if condition := findCondition(u, conditionType); condition != nil {
+		status, _ := condition["status"].(string)
+		return status
+	}
+	return ""
+}
+
+// conditionReason returns the reason and message of the condition type in status.conditions.
+func conditionReason(u *unstruct.Unstructured, conditionType string) (string, string) {
+	if condition := findCondition(u, conditionType); condition != nil {
+		reason, _ := condition["reason"].(string)
+		message, _ := condition["message"].(string)
+		return reason, message
+	}
+	return "", ""
+}
+
+func findCondition(u *unstruct.Unstructured, conditionType string) map[string]interface{} {
+	conditions, _, _ := unstruct.NestedSlice(u.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if condition["type"] == conditionType {
+			return condition
+		}
+	}
+	return nil
+}
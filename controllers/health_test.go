@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"testing"
+
+	v1 "github.com/slipway-gitops/slipway/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	unstruct "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func newObject(apiVersion, kind string, fields map[string]interface{}) *unstruct.Unstructured {
+	u := &unstruct.Unstructured{Object: fields}
+	u.SetAPIVersion(apiVersion)
+	u.SetKind(kind)
+	u.SetName("test")
+	return u
+}
+
+func TestObjectHealth(t *testing.T) {
+	tests := []struct {
+		name   string
+		object *unstruct.Unstructured
+		health v1.HealthStatus
+	}{
+		{
+			name: "deployment with old replicas",
+			object: newObject("apps/v1", "Deployment", map[string]interface{}{
+				"spec": map[string]interface{}{"replicas": int64(2)},
+				"status": map[string]interface{}{
+					"observedGeneration": int64(0),
+					"replicas":           int64(3),
+					"updatedReplicas":    int64(2),
+					"availableReplicas":  int64(2),
+				},
+			}),
+			health: v1.HealthProgressing,
+		},
+		{
+			name: "deployment rolled out",
+			object: newObject("apps/v1", "Deployment", map[string]interface{}{
+				"status": map[string]interface{}{
+					"observedGeneration": int64(0),
+					"replicas":           int64(1),
+					"updatedReplicas":    int64(1),
+					"availableReplicas":  int64(1),
+				},
+			}),
+			health: v1.HealthHealthy,
+		},
+		{
+			name: "deployment past its deadline",
+			object: newObject("apps/v1", "Deployment", map[string]interface{}{
+				"status": map[string]interface{}{
+					"observedGeneration": int64(0),
+					"conditions": []interface{}{
+						map[string]interface{}{"type": "Progressing", "status": "False", "reason": "ProgressDeadlineExceeded"},
+					},
+				},
+			}),
+			health: v1.HealthDegraded,
+		},
+		{
+			name: "failed job",
+			object: newObject("batch/v1", "Job", map[string]interface{}{
+				"status": map[string]interface{}{
+					"conditions": []interface{}{
+						map[string]interface{}{"type": "Failed", "status": "True"},
+					},
+				},
+			}),
+			health: v1.HealthDegraded,
+		},
+		{
+			name:   "pending claim",
+			object: newObject("v1", "PersistentVolumeClaim", map[string]interface{}{}),
+			health: v1.HealthProgressing,
+		},
+		{
+			name: "load balancer without ingress",
+			object: newObject("v1", "Service", map[string]interface{}{
+				"spec": map[string]interface{}{"type": "LoadBalancer"},
+			}),
+			health: v1.HealthProgressing,
+		},
+		{
+			name: "cluster ip service",
+			object: newObject("v1", "Service", map[string]interface{}{
+				"spec": map[string]interface{}{"type": "ClusterIP"},
+			}),
+			health: v1.HealthHealthy,
+		},
+		{
+			name: "custom resource not ready",
+			object: newObject("example.com/v1", "Database", map[string]interface{}{
+				"status": map[string]interface{}{
+					"conditions": []interface{}{
+						map[string]interface{}{"type": "Ready", "status": "False"},
+					},
+				},
+			}),
+			health: v1.HealthProgressing,
+		},
+		{
+			name: "custom resource stalled",
+			object: newObject("example.com/v1", "Database", map[string]interface{}{
+				"status": map[string]interface{}{
+					"conditions": []interface{}{
+						map[string]interface{}{"type": "Stalled", "status": "True"},
+					},
+				},
+			}),
+			health: v1.HealthDegraded,
+		},
+		{
+			name:   "configmap",
+			object: newObject("v1", "ConfigMap", map[string]interface{}{}),
+			health: v1.HealthHealthy,
+		},
+	}
+	for _, test := range tests {
+		if health, msg := objectHealth(test.object); health != test.health {
+			t.Errorf("%s: expected %s got %s %s", test.name, test.health, health, msg)
+		}
+	}
+}
+
+func TestSetHealth(t *testing.T) {
+	hash := &v1.Hash{}
+	hash.Generation = 3
+	then := metav1.Unix(0, 0)
+	setHealth(hash, v1.HealthProgressing, "StageProgressing", "waiting", then)
+	if hash.Status.ObservedGeneration != 3 || len(hash.Status.Conditions) != 3 {
+		t.Fatalf("Expected 3 conditions for generation 3 got %v", hash.Status)
+	}
+	for i, conditionType := range []v1.ConditionType{v1.ConditionReady, v1.ConditionProgressing, v1.ConditionDegraded} {
+		if hash.Status.Conditions[i].Type != conditionType {
+			t.Errorf("Expected %s at %d got %s", conditionType, i, hash.Status.Conditions[i].Type)
+		}
+	}
+	now := metav1.Now()
+	setHealth(hash, v1.HealthHealthy, "Ready", "done", now)
+	for _, c := range hash.Status.Conditions {
+		switch c.Type {
+		case v1.ConditionReady:
+			if c.Status != "True" || !c.LastTransitionTime.Equal(&now) {
+				t.Errorf("Expected Ready to transition to True got %v", c)
+			}
+		case v1.ConditionDegraded:
+			if c.Status != "False" || !c.LastTransitionTime.Equal(&then) {
+				t.Errorf("Expected Degraded to stay False got %v", c)
+			}
+		}
+	}
+}
@@ -0,0 +1,391 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	unstruct "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/kustomize/api/krusty"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	gitv1 "github.com/slipway-gitops/slipway/api/v1"
+)
+
+const (
+	// HookAnnotation marks a rendered Job as a hook, the value is a comma
+	// separated list of pre-apply, post-apply and pre-delete.
+	HookAnnotation = "git.gitops.slipway.org/hook"
+	// HookDeletePolicyAnnotation is a comma separated list of when a hook Job is deleted:
+	// before-hook-creation (the default), hook-succeeded and hook-failed.
+	HookDeletePolicyAnnotation = "git.gitops.slipway.org/hook-delete-policy"
+	// HookFinalizer holds a deleted Hash until its pre-delete hooks ran.
+	HookFinalizer = "git.gitops.slipway.org/hooks"
+
+	hookBeforeCreation = "before-hook-creation"
+	hookSucceeded      = "hook-succeeded"
+	hookFailed         = "hook-failed"
+)
+
+var (
+	ErrInvalidHook = errors.New("Hooks must be Jobs")
+	ErrHookExists  = errors.New("Hook Job already exists")
+)
+
+// hook is a rendered Job annotated to run at specific moments.
+type hook struct {
+	Types          []gitv1.HookType
+	DeletePolicies []string
+	Job            *unstruct.Unstructured
+}
+
+func (h hook) is(hookType gitv1.HookType) bool {
+	for _, t := range h.Types {
+		if t == hookType {
+			return true
+		}
+	}
+	return false
+}
+
+func (h hook) deletedOn(policy string) bool {
+	return containsString(h.DeletePolicies, policy)
+}
+
+// splitHooks separates the objects annotated as hooks from the objects to apply.
+func splitHooks(objs []*unstruct.Unstructured) (hooks []hook, objects []*unstruct.Unstructured, err error) {
+	for _, u := range objs {
+		annotation, ok := u.GetAnnotations()[HookAnnotation]
+		if !ok {
+			objects = append(objects, u)
+			continue
+		}
+		if u.GroupVersionKind().GroupKind().String() != "Job.batch" {
+			return nil, nil, fmt.Errorf("%w: Kind:%s Named:%s", ErrInvalidHook, u.GetKind(), u.GetName())
+		}
+		h := hook{
+			Job:            u,
+			DeletePolicies: []string{hookBeforeCreation},
+		}
+		for _, t := range strings.Split(annotation, ",") {
+			h.Types = append(h.Types, gitv1.HookType(strings.TrimSpace(t)))
+		}
+		if policy, ok := u.GetAnnotations()[HookDeletePolicyAnnotation]; ok {
+			h.DeletePolicies = nil
+			for _, p := range strings.Split(policy, ",") {
+				h.DeletePolicies = append(h.DeletePolicies, strings.TrimSpace(p))
+			}
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, objects, nil
+}
+
+// runHooks runs the hooks of a type for an operation one after another.
+// A hook only runs once for a Hash, its result is kept in the Hash status.
+// The returned health is Healthy when all hooks succeeded, Progressing while
+// one is running and Degraded when one failed.
+func (r *HashReconciler) runHooks(
+	ctx context.Context,
+	log logr.Logger,
+	hash *gitv1.Hash,
+	op *renderedOperation,
+	hookType gitv1.HookType,
+) (gitv1.HealthStatus, string, error) {
+	for _, h := range op.Hooks {
+		if !h.is(hookType) {
+			continue
+		}
+		status := hookStatus(hash, op.Operation.Name, hookType, h.Job)
+		switch status.Phase {
+		case gitv1.HookSucceeded:
+			continue
+		case gitv1.HookFailed:
+			return gitv1.HealthDegraded, hookMessage(status), nil
+		}
+		job, err := r.ensureHookJob(ctx, log, hash, op.Cluster, h, status)
+		if err != nil {
+			return gitv1.HealthDegraded, hookMessage(status), err
+		}
+		if job == nil {
+			status.Message = "replacing previous Job"
+			return gitv1.HealthProgressing, hookMessage(status), nil
+		}
+		health, message := objectHealth(job)
+		status.Message = message
+		if health == gitv1.HealthProgressing {
+			return health, hookMessage(status), nil
+		}
+		now := metav1.Now()
+		status.CompletionTime = &now
+		policy := hookSucceeded
+		status.Phase = gitv1.HookSucceeded
+		if health == gitv1.HealthDegraded {
+			policy = hookFailed
+			status.Phase = gitv1.HookFailed
+		}
+		r.recorder.Event(
+			hash,
+			"Normal",
+			string(status.Phase),
+			fmt.Sprintf("Hook %s %s Kind:Job Named:%s in Namespace:%s",
+				hookType,
+				strings.ToLower(string(status.Phase)),
+				job.GetName(),
+				job.GetNamespace(),
+			),
+		)
+		if h.deletedOn(policy) {
+			if err := op.Cluster.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil {
+				log.Error(err, "unable to delete hook", "job", job)
+			}
+		}
+		if status.Phase == gitv1.HookFailed {
+			return gitv1.HealthDegraded, hookMessage(status), nil
+		}
+	}
+	return gitv1.HealthHealthy, "", nil
+}
+
+// ensureHookJob creates the Job of a hook and returns its current state.
+// A Job of the same name that was not created for this Hash is deleted first
+// when the hook uses before-hook-creation, nil is returned until it is gone.
+func (r *HashReconciler) ensureHookJob(
+	ctx context.Context,
+	log logr.Logger,
+	hash *gitv1.Hash,
+	c *cluster,
+	h hook,
+	status *gitv1.HookStatus,
+) (*unstruct.Unstructured, error) {
+	job := h.Job.DeepCopy()
+	if job.GetNamespace() == "" {
+		job.SetNamespace(defaultNamespace)
+	}
+	existing := &unstruct.Unstructured{}
+	existing.SetGroupVersionKind(job.GroupVersionKind())
+	err := c.Get(ctx, types.NamespacedName{Name: job.GetName(), Namespace: job.GetNamespace()}, existing)
+	switch {
+	case err == nil && c.owns(hash, existing):
+		return existing, nil
+	case err == nil && !h.deletedOn(hookBeforeCreation):
+		return nil, fmt.Errorf("%w: Named:%s in Namespace:%s", ErrHookExists, job.GetName(), job.GetNamespace())
+	case err == nil:
+		if existing.GetDeletionTimestamp() == nil {
+			err := c.Delete(ctx, existing, client.PropagationPolicy(metav1.DeletePropagationBackground))
+			if err != nil && !apierrors.IsNotFound(err) {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case !apierrors.IsNotFound(err):
+		return nil, err
+	}
+	if err := c.own(hash, job, r.Scheme); err != nil {
+		return nil, err
+	}
+	if err := c.Create(ctx, job); err != nil {
+		return nil, err
+	}
+	now := metav1.Now()
+	status.Phase = gitv1.HookRunning
+	status.StartTime = &now
+	r.recorder.Event(
+		hash,
+		"Normal",
+		"created",
+		fmt.Sprintf("Hook %s started Kind:Job Named:%s in Namespace:%s",
+			status.Type,
+			job.GetName(),
+			job.GetNamespace(),
+		),
+	)
+	if err := c.watch(job, hash); err != nil {
+		log.Error(err, "unable to set watch on hook", "job", job, "hash", hash)
+	}
+	return job, nil
+}
+
+// hookStatus returns the status entry of a hook, adding it when missing.
+func hookStatus(hash *gitv1.Hash, operation string, hookType gitv1.HookType, job *unstruct.Unstructured) *gitv1.HookStatus {
+	namespace := job.GetNamespace()
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	for i, s := range hash.Status.Hooks {
+		if s.Operation == operation &&
+			s.Type == hookType &&
+			s.Name == job.GetName() &&
+			s.Namespace == namespace {
+			return &hash.Status.Hooks[i]
+		}
+	}
+	hash.Status.Hooks = append(hash.Status.Hooks, gitv1.HookStatus{
+		Operation: operation,
+		Type:      hookType,
+		Name:      job.GetName(),
+		Namespace: namespace,
+		Phase:     gitv1.HookRunning,
+	})
+	return &hash.Status.Hooks[len(hash.Status.Hooks)-1]
+}
+
+// hookTimedOut reports if a running hook of the operation exceeded the timeout.
+func hookTimedOut(hash *gitv1.Hash, operation string, hookType gitv1.HookType, timeout time.Duration, now time.Time) bool {
+	for _, s := range hash.Status.Hooks {
+		if s.Operation == operation &&
+			s.Type == hookType &&
+			s.Phase == gitv1.HookRunning &&
+			s.StartTime != nil &&
+			now.Sub(s.StartTime.Time) > timeout {
+			return true
+		}
+	}
+	return false
+}
+
+func hookMessage(status *gitv1.HookStatus) string {
+	return fmt.Sprintf("Hook %s Kind:Job Named:%s %s", status.Type, status.Name, status.Message)
+}
+
+// reconcileDelete runs the pre-delete hooks of a Hash that is being deleted,
+// removes its objects from remote clusters and then releases it so its other
+// objects are garbage collected. Failed or timed out hooks are reported as
+// events but do not block the deletion. Without a kustomizer the hooks are skipped.
+func (r *HashReconciler) reconcileDelete(
+	ctx context.Context,
+	log logr.Logger,
+	hash *gitv1.Hash,
+	k *krusty.Kustomizer,
+) (ctrl.Result, error) {
+	if !containsString(hash.Finalizers, HookFinalizer) && !containsString(hash.Finalizers, TargetFinalizer) {
+		return ctrl.Result{}, nil
+	}
+	if k != nil && containsString(hash.Finalizers, HookFinalizer) {
+		if result, waiting := r.runPreDeleteHooks(ctx, log, hash, k); waiting {
+			return result, nil
+		}
+	}
+	// Objects in remote clusters are kept until they could be removed
+	finalizers := removeString(hash.Finalizers, HookFinalizer)
+	err := r.deleteTargets(ctx, log, hash)
+	if err != nil {
+		log.Error(err, "unable to remove objects from targets")
+	} else {
+		finalizers = removeString(finalizers, TargetFinalizer)
+	}
+	if err := r.Status().Update(ctx, hash); err != nil {
+		log.Error(err, "unable to update Hash status")
+	}
+	hash.Finalizers = finalizers
+	if err := r.Update(ctx, hash); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, err
+}
+
+// runPreDeleteHooks runs the pre-delete hooks of every operation in order,
+// it reports waiting with the result to requeue while a hook is running.
+func (r *HashReconciler) runPreDeleteHooks(
+	ctx context.Context,
+	log logr.Logger,
+	hash *gitv1.Hash,
+	k *krusty.Kustomizer,
+) (ctrl.Result, bool) {
+	for _, stage := range operationStages(hash.Spec.Operations) {
+		for _, operation := range stage.Operations {
+			op, err := r.renderOperation(ctx, log, hash, k, operation)
+			if err != nil {
+				log.Error(err, "unable to render pre-delete hooks", "operation", operation)
+				r.recorder.Event(
+					hash,
+					"Warning",
+					"HookFailed",
+					fmt.Sprintf("Unable to render pre-delete hooks for operation %s: %s", operation.Name, err),
+				)
+				continue
+			}
+			if op == nil {
+				continue
+			}
+			health, message, err := r.runHooks(ctx, log, hash, op, gitv1.HookPreDelete)
+			if err == nil &&
+				health == gitv1.HealthProgressing &&
+				!hookTimedOut(hash, operation.Name, gitv1.HookPreDelete, stage.Timeout, time.Now()) {
+				log.Info("Waiting on pre-delete hook", "operation", operation.Name, "message", message)
+				if err := r.Status().Update(ctx, hash); err != nil {
+					log.Error(err, "unable to update Hash status")
+				}
+				return ctrl.Result{RequeueAfter: stageRequeue}, true
+			}
+			if err != nil || health != gitv1.HealthHealthy {
+				log.Error(err, "pre-delete hook failed", "operation", operation.Name, "message", message)
+				r.recorder.Event(
+					hash,
+					"Warning",
+					"HookFailed",
+					fmt.Sprintf("Pre-delete hook for operation %s did not succeed: %s", operation.Name, message),
+				)
+			}
+		}
+	}
+	return ctrl.Result{}, false
+}
+
+// addFinalizer adds a finalizer to a Hash without touching the status
+// that is being built for it.
+func (r *HashReconciler) addFinalizer(ctx context.Context, hash *gitv1.Hash, finalizer string) error {
+	if containsString(hash.Finalizers, finalizer) {
+		return nil
+	}
+	latest := hash.DeepCopy()
+	latest.Finalizers = append(latest.Finalizers, finalizer)
+	if err := r.Update(ctx, latest); err != nil {
+		return err
+	}
+	hash.Finalizers = latest.Finalizers
+	hash.ResourceVersion = latest.ResourceVersion
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) (result []string) {
+	for _, v := range list {
+		if v != s {
+			result = append(result, v)
+		}
+	}
+	return result
+}
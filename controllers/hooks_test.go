@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"errors"
+	"testing"
+
+	v1 "github.com/slipway-gitops/slipway/api/v1"
+	unstruct "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestSplitHooks(t *testing.T) {
+	job := newObject("batch/v1", "Job", nil)
+	job.SetName("migrate")
+	job.SetAnnotations(map[string]string{
+		HookAnnotation:             "pre-apply, pre-delete",
+		HookDeletePolicyAnnotation: "hook-succeeded",
+	})
+	cm := newObject("v1", "ConfigMap", nil)
+	cm.SetName("config")
+
+	hooks, objects, err := splitHooks([]*unstruct.Unstructured{job, cm})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(objects) != 1 || objects[0].GetName() != "config" {
+		t.Errorf("Expected only the ConfigMap to be applied got %v", objects)
+	}
+	if len(hooks) != 1 {
+		t.Fatalf("Expected 1 hook got %d", len(hooks))
+	}
+	if !hooks[0].is(v1.HookPreApply) || !hooks[0].is(v1.HookPreDelete) || hooks[0].is(v1.HookPostApply) {
+		t.Errorf("Unexpected hook types %v", hooks[0].Types)
+	}
+	if !hooks[0].deletedOn(hookSucceeded) || hooks[0].deletedOn(hookBeforeCreation) {
+		t.Errorf("Unexpected delete policies %v", hooks[0].DeletePolicies)
+	}
+
+	cm.SetAnnotations(map[string]string{HookAnnotation: "pre-apply"})
+	if _, _, err := splitHooks([]*unstruct.Unstructured{cm}); !errors.Is(err, ErrInvalidHook) {
+		t.Errorf("Expected ErrInvalidHook got %v", err)
+	}
+}
+
+func TestHookStatus(t *testing.T) {
+	hash := &v1.Hash{}
+	job := newObject("batch/v1", "Job", nil)
+	job.SetName("migrate")
+
+	status := hookStatus(hash, "app", v1.HookPreApply, job)
+	if status.Namespace != "default" || status.Phase != v1.HookRunning {
+		t.Errorf("Unexpected new hook status %v", status)
+	}
+	status.Phase = v1.HookSucceeded
+	if again := hookStatus(hash, "app", v1.HookPreApply, job); again.Phase != v1.HookSucceeded {
+		t.Errorf("Expected the existing hook status got %v", again)
+	}
+	hookStatus(hash, "app", v1.HookPostApply, job)
+	if len(hash.Status.Hooks) != 2 {
+		t.Errorf("Expected 2 hook statuses got %d", len(hash.Status.Hooks))
+	}
+}
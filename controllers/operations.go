@@ -0,0 +1,113 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/go-logr/logr"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/kustomize/api/resmap"
+
+	gitv1 "github.com/slipway-gitops/slipway/api/v1"
+)
+
+// renderDigest is the sha256 of the rendered manifests of an operation.
+func renderDigest(m resmap.ResMap) (string, error) {
+	yaml, err := m.AsYaml()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(yaml)), nil
+}
+
+// startOperation adds the status of an operation to the Hash, starting from
+// its previous status.
+func startOperation(hash *gitv1.Hash, operation gitv1.Operation, previous []gitv1.OperationStatus) *gitv1.OperationStatus {
+	status := gitv1.OperationStatus{Name: operation.Name}
+	for _, p := range previous {
+		if p.Name == operation.Name {
+			status = p
+		}
+	}
+	status.ReferenceTitle = operation.ReferenceTitle
+	hash.Status.Operations = append(hash.Status.Operations, status)
+	return &hash.Status.Operations[len(hash.Status.Operations)-1]
+}
+
+// operationStatus returns the status of an operation, nil when it has none.
+func operationStatus(hash *gitv1.Hash, name string) *gitv1.OperationStatus {
+	for i := range hash.Status.Operations {
+		if hash.Status.Operations[i].Name == name {
+			return &hash.Status.Operations[i]
+		}
+	}
+	return nil
+}
+
+// operationApplied records a complete apply of an operation.
+func operationApplied(status *gitv1.OperationStatus, objects []corev1.ObjectReference, now metav1.Time) {
+	status.Objects = objects
+	status.LastAppliedTime = &now
+	status.LastError = ""
+	status.LastErrorReason = ""
+	status.Attempts = 0
+}
+
+// keepOperations adds back the previous status of operations that were not
+// reached, operations no longer in the Hash are dropped.
+func keepOperations(hash *gitv1.Hash, previous []gitv1.OperationStatus) {
+	for _, p := range previous {
+		if operationStatus(hash, p.Name) != nil {
+			continue
+		}
+		for _, op := range hash.Spec.Operations {
+			if op.Name == p.Name {
+				hash.Status.Operations = append(hash.Status.Operations, p)
+				break
+			}
+		}
+	}
+}
+
+// failOperation records a failed attempt of an operation. With the Continue
+// failure policy the objects it applied before are kept and true is returned
+// so the other operations proceed.
+func (r *HashReconciler) failOperation(log logr.Logger, hash *gitv1.Hash, operation gitv1.Operation, err error) bool {
+	reason, message := applyError(hash, err, "OperationFailed")
+	status := operationStatus(hash, operation.Name)
+	status.LastError = message
+	status.LastErrorReason = reason
+	status.Attempts++
+	if operation.FailurePolicy != gitv1.FailurePolicyContinue {
+		return false
+	}
+	log.Error(err, "operation failed, continuing with the other operations", "operation", operation.Name)
+	r.recorder.Event(
+		hash,
+		"Warning",
+		reason,
+		fmt.Sprintf("Operation %s failed: %s", operation.Name, message),
+	)
+	if len(status.Objects) > 0 {
+		key := targetKey(operation.Target)
+		setObjectReferences(hash, key, mergeObjectReferences(objectReferences(hash, key), status.Objects))
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	v1 "github.com/slipway-gitops/slipway/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestOperationStatus(t *testing.T) {
+	r := &HashReconciler{recorder: record.NewFakeRecorder(10)}
+	log := ctrl.Log.WithName("test")
+	app := v1.Operation{Name: "app", ReferenceTitle: "master", FailurePolicy: v1.FailurePolicyContinue}
+	db := v1.Operation{Name: "db", ReferenceTitle: "master"}
+	hash := &v1.Hash{Spec: v1.HashSpec{Operations: []v1.Operation{app, db}}}
+	cm := corev1.ObjectReference{Kind: "ConfigMap", Name: "app"}
+
+	operationApplied(startOperation(hash, app, nil), []corev1.ObjectReference{cm}, metav1.Now())
+	previous := hash.Status.Operations
+	hash.Status.Operations = nil
+	hash.Status.Objects = nil
+
+	startOperation(hash, app, previous)
+	if !r.failOperation(log, hash, app, errors.New("render failed")) {
+		t.Errorf("Expected the Continue failure policy to proceed")
+	}
+	status := operationStatus(hash, "app")
+	if status.Attempts != 1 || status.LastError != "render failed" || status.LastAppliedTime == nil {
+		t.Errorf("Unexpected failed status %v", status)
+	}
+	if !containsObjectReference(hash.Status.Objects, cm) {
+		t.Errorf("Expected the objects of the failed operation to be kept got %v", hash.Status.Objects)
+	}
+
+	startOperation(hash, db, previous)
+	if r.failOperation(log, hash, db, errors.New("apply failed")) {
+		t.Errorf("Expected the Halt failure policy to stop")
+	}
+
+	forbidden := apierrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "app", errors.New("denied"))
+	hash.Spec.ServiceAccountName = "apps/deployer"
+	r.failOperation(log, hash, app, forbidden)
+	status = operationStatus(hash, "app")
+	if status.LastErrorReason != "Forbidden" || !strings.HasPrefix(status.LastError, "ServiceAccount apps/deployer:") {
+		t.Errorf("Expected the Forbidden reason got %v", status)
+	}
+
+	hash.Status.Operations = nil
+	hash.Spec.Operations = []v1.Operation{app}
+	keepOperations(hash, append(previous, v1.OperationStatus{Name: "removed"}))
+	if len(hash.Status.Operations) != 1 || hash.Status.Operations[0].Name != "app" {
+		t.Errorf("Expected only the status of app to be kept got %v", hash.Status.Operations)
+	}
+}
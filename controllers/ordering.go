@@ -0,0 +1,132 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	unstruct "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+
+	gitv1 "github.com/slipway-gitops/slipway/api/v1"
+)
+
+// applyOrder is the order kinds are applied in within an operation.
+// Kinds that are not listed, such as custom resources, are applied after
+// the listed kinds and before the webhook configurations.
+var applyOrder = []string{
+	"Namespace",
+	"ResourceQuota",
+	"LimitRange",
+	"PodSecurityPolicy",
+	"CustomResourceDefinition",
+	"ServiceAccount",
+	"ClusterRole",
+	"ClusterRoleBinding",
+	"Role",
+	"RoleBinding",
+	"Secret",
+	"ConfigMap",
+	"StorageClass",
+	"PersistentVolume",
+	"PersistentVolumeClaim",
+	"Service",
+	"DaemonSet",
+	"Pod",
+	"ReplicationController",
+	"ReplicaSet",
+	"Deployment",
+	"StatefulSet",
+	"Job",
+	"CronJob",
+	"HorizontalPodAutoscaler",
+	"PodDisruptionBudget",
+	"NetworkPolicy",
+	"Ingress",
+	"APIService",
+}
+
+// Kinds applied after everything else, their Services have to exist first
+var applyLast = []string{
+	"MutatingWebhookConfiguration",
+	"ValidatingWebhookConfiguration",
+}
+
+// kindRank returns the position of a kind in the apply order.
+func kindRank(kind string) int {
+	for i, k := range applyOrder {
+		if k == kind {
+			return i
+		}
+	}
+	for i, k := range applyLast {
+		if k == kind {
+			return len(applyOrder) + 1 + i
+		}
+	}
+	return len(applyOrder)
+}
+
+// sortObjects orders objects by kind, objects of the same kind keep their order.
+func sortObjects(objs []*unstruct.Unstructured) {
+	sort.SliceStable(objs, func(i, j int) bool {
+		return kindRank(objs[i].GetKind()) < kindRank(objs[j].GetKind())
+	})
+}
+
+// definedKinds returns the CustomResourceDefinitions in objs by the kind they define.
+func definedKinds(objs []*unstruct.Unstructured) map[schema.GroupKind]*unstruct.Unstructured {
+	kinds := make(map[schema.GroupKind]*unstruct.Unstructured)
+	for _, u := range objs {
+		if u.GroupVersionKind().GroupKind().String() != "CustomResourceDefinition.apiextensions.k8s.io" {
+			continue
+		}
+		group, _, _ := unstruct.NestedString(u.Object, "spec", "group")
+		kind, _, _ := unstruct.NestedString(u.Object, "spec", "names", "kind")
+		kinds[schema.GroupKind{Group: group, Kind: kind}] = u
+	}
+	return kinds
+}
+
+// kindPending checks if the kind of a custom resource can be applied.
+// The CustomResourceDefinition has to be established and the RESTMapper has
+// to have discovered the kind, it is reloaded when the kind is missing.
+// A message describing what is waited on is returned while it cannot be applied.
+func (r *HashReconciler) kindPending(
+	ctx context.Context,
+	c *cluster,
+	crd *unstruct.Unstructured,
+	gvk schema.GroupVersionKind,
+) (string, error) {
+	current := &unstruct.Unstructured{}
+	current.SetGroupVersionKind(crd.GroupVersionKind())
+	if err := c.Get(ctx, types.NamespacedName{Name: crd.GetName()}, current); err != nil {
+		return "", err
+	}
+	if health, message := objectHealth(current); health != gitv1.HealthHealthy {
+		return fmt.Sprintf("waiting on Kind:CustomResourceDefinition Named:%s %s", crd.GetName(), message), nil
+	}
+	_, err := c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if _, limited := apiutil.DelayIfRateLimited(err); limited || meta.IsNoMatchError(err) {
+		return fmt.Sprintf("waiting on discovery of %s", gvk), nil
+	}
+	return "", err
+}
@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"testing"
+
+	unstruct "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestSortObjects(t *testing.T) {
+	objs := []*unstruct.Unstructured{
+		newObject("admissionregistration.k8s.io/v1", "ValidatingWebhookConfiguration", nil),
+		newObject("example.com/v1", "Widget", nil),
+		newObject("apps/v1", "Deployment", nil),
+		newObject("v1", "ConfigMap", nil),
+		newObject("rbac.authorization.k8s.io/v1", "ClusterRole", nil),
+		newObject("apiextensions.k8s.io/v1", "CustomResourceDefinition", nil),
+		newObject("v1", "Namespace", nil),
+	}
+	sortObjects(objs)
+	expected := []string{
+		"Namespace",
+		"CustomResourceDefinition",
+		"ClusterRole",
+		"ConfigMap",
+		"Deployment",
+		"Widget",
+		"ValidatingWebhookConfiguration",
+	}
+	for i, kind := range expected {
+		if objs[i].GetKind() != kind {
+			t.Errorf("Expected %s at %d got %s", kind, i, objs[i].GetKind())
+		}
+	}
+}
+
+func TestDefinedKinds(t *testing.T) {
+	crd := newObject("apiextensions.k8s.io/v1beta1", "CustomResourceDefinition", map[string]interface{}{
+		"spec": map[string]interface{}{
+			"group": "example.com",
+			"names": map[string]interface{}{"kind": "Widget"},
+		},
+	})
+	kinds := definedKinds([]*unstruct.Unstructured{crd, newObject("v1", "ConfigMap", nil)})
+	if len(kinds) != 1 || kinds[schema.GroupKind{Group: "example.com", Kind: "Widget"}] != crd {
+		t.Errorf("Expected Widget.example.com to be defined got %v", kinds)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+	unstruct "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	gitv1 "github.com/slipway-gitops/slipway/api/v1"
+)
+
+// policyViolation returns why the policy does not allow an object to be
+// applied, empty when it is allowed. Objects without a namespace are expected
+// to be cluster-scoped, setScope has to run first.
+func policyViolation(policy *gitv1.Policy, u *unstruct.Unstructured) string {
+	if policy == nil {
+		return ""
+	}
+	gk := u.GroupVersionKind().GroupKind()
+	if matchesAny(policy.DeniedKinds, gk.String()) {
+		return fmt.Sprintf("kind %s is denied", gk)
+	}
+	if len(policy.AllowedKinds) > 0 && !matchesAny(policy.AllowedKinds, gk.String()) {
+		return fmt.Sprintf("kind %s is not allowed", gk)
+	}
+	namespace := u.GetNamespace()
+	switch {
+	case gk.String() == "Namespace":
+		namespace = u.GetName()
+	case namespace == "" && !policy.ClusterScoped:
+		return "cluster-scoped objects are not allowed"
+	case namespace == "":
+		return ""
+	}
+	if len(policy.Namespaces) > 0 && !matchesAny(policy.Namespaces, namespace) {
+		return fmt.Sprintf("namespace %s is not allowed", namespace)
+	}
+	return ""
+}
+
+// matchesAny reports if the value matches one of the globs.
+func matchesAny(globs []string, value string) bool {
+	for _, g := range globs {
+		if ok, _ := path.Match(g, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectedObject describes an object rejected by the policy for the Hash status.
+func rejectedObject(operation string, u *unstruct.Unstructured, message string) gitv1.RejectedObject {
+	return gitv1.RejectedObject{
+		Operation: operation,
+		Object: corev1.ObjectReference{
+			APIVersion: u.GetAPIVersion(),
+			Kind:       u.GetKind(),
+			Name:       u.GetName(),
+			Namespace:  u.GetNamespace(),
+		},
+		Message: message,
+	}
+}
+
+// recordRejected adds objects rejected by the policy to the Hash status and
+// reports them as events.
+func (r *HashReconciler) recordRejected(hash *gitv1.Hash, rejected []gitv1.RejectedObject) {
+	for _, rej := range rejected {
+		hash.Status.Rejected = append(hash.Status.Rejected, rej)
+		r.recorder.Event(
+			hash,
+			"Warning",
+			"PolicyViolation",
+			fmt.Sprintf("Rejected Kind:%s Named:%s in Namespace:%s %s",
+				rej.Object.Kind,
+				rej.Object.Name,
+				rej.Object.Namespace,
+				rej.Message,
+			),
+		)
+	}
+}
@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"testing"
+
+	v1 "github.com/slipway-gitops/slipway/api/v1"
+)
+
+func TestPolicyViolation(t *testing.T) {
+	policy := &v1.Policy{
+		Namespaces:  []string{"team-*"},
+		DeniedKinds: []string{"*.rbac.authorization.k8s.io"},
+	}
+	tests := []struct {
+		name       string
+		apiVersion string
+		kind       string
+		namespace  string
+		policy     *v1.Policy
+		allowed    bool
+	}{
+		{"no policy", "v1", "ConfigMap", "kube-system", nil, true},
+		{"allowed namespace", "v1", "ConfigMap", "team-a", policy, true},
+		{"denied namespace", "v1", "ConfigMap", "kube-system", policy, false},
+		{"denied kind", "rbac.authorization.k8s.io/v1", "RoleBinding", "team-a", policy, false},
+		{"cluster scoped", "storage.k8s.io/v1", "StorageClass", "", policy, false},
+		{"cluster scoped allowed", "storage.k8s.io/v1", "StorageClass", "", &v1.Policy{ClusterScoped: true}, true},
+		{"not allowed kind", "apps/v1", "Deployment", "team-a", &v1.Policy{AllowedKinds: []string{"ConfigMap"}}, false},
+		{"allowed kind", "v1", "ConfigMap", "team-a", &v1.Policy{AllowedKinds: []string{"ConfigMap"}}, true},
+	}
+	for _, tt := range tests {
+		u := newObject(tt.apiVersion, tt.kind, nil)
+		u.SetNamespace(tt.namespace)
+		message := policyViolation(tt.policy, u)
+		if (message == "") != tt.allowed {
+			t.Errorf("%s: expected allowed %v got %q", tt.name, tt.allowed, message)
+		}
+	}
+
+	ns := newObject("v1", "Namespace", nil)
+	ns.SetName("kube-system")
+	if policyViolation(policy, ns) == "" {
+		t.Errorf("Expected the kube-system Namespace to be rejected")
+	}
+	ns.SetName("team-b")
+	if message := policyViolation(policy, ns); message != "" {
+		t.Errorf("Expected the team-b Namespace to be allowed got %q", message)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-logr/logr"
+
+	"sigs.k8s.io/kustomize/api/k8sdeps/kunstruct"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/resource"
+
+	gitv1 "github.com/slipway-gitops/slipway/api/v1"
+	"github.com/slipway-gitops/slipway/pkg/gitfetch"
+	"github.com/slipway-gitops/slipway/pkg/rendercache"
+)
+
+const (
+	// Rendered operations kept in memory
+	renderCacheSize = 256
+	// Rendered operations kept on disk
+	renderCacheDiskSize = 4096
+)
+
+var resmapFactory = resmap.NewFactory(resource.NewFactory(kunstruct.NewKunstructuredFactoryImpl()), nil)
+
+// cachedRender is what is kept in the render cache for an operation.
+type cachedRender struct {
+	Namespaces []string `json:"namespaces,omitempty"`
+	Manifests  []byte   `json:"manifests"`
+	// Encrypted Secrets as the renderer output them
+	Encrypted []json.RawMessage `json:"encrypted,omitempty"`
+}
+
+// renderKey identifies the rendered output of an operation at a commit, it
+// changes with the path, the commit its remote path resolves to, the renderer
+// and anything the transformers use.
+func renderKey(hash *gitv1.Hash, operation gitv1.Operation, commit string) (string, error) {
+	// Only the fields used to render are part of the key
+	operation.Weight = 0
+	operation.Timeout = nil
+	operation.Target = nil
+	operation.FailurePolicy = ""
+	input, err := json.Marshal(operation)
+	if err != nil {
+		return "", err
+	}
+	return rendercache.Key(hash.Name, hash.Spec.GitRepo, commit, string(input)), nil
+}
+
+// operationPath is the path of an operation, pinned to the commit of the Hash
+// when HashPath is set.
+func operationPath(hash *gitv1.Hash, operation gitv1.Operation) string {
+	if operation.HashPath {
+		return fmt.Sprintf("%v?ref=%v", operation.Path, hash.Name)
+	}
+	return operation.Path
+}
+
+// remoteCommit resolves the commit a remote path is at, fetching refs such as
+// branches that move. It returns false for remote paths that cannot be
+// resolved without a workspace and "" for local paths.
+func (r *HashReconciler) remoteCommit(ctx context.Context, hash *gitv1.Hash, operation gitv1.Operation) (string, bool, error) {
+	remote, ok := gitfetch.Parse(operationPath(hash, operation))
+	if !ok {
+		return "", true, nil
+	}
+	if r.workspace == nil {
+		return "", false, nil
+	}
+	auth, err := gitAuth(ctx, r.Client, hash.Spec.SecretName, remote.Repo)
+	if err != nil {
+		return "", false, err
+	}
+	commit, err := r.workspace.Commit(ctx, remote.Repo, remote.Ref, hash.Spec.SecretName, auth)
+	if err != nil {
+		return "", false, err
+	}
+	return commit.SHA, true, nil
+}
+
+// render returns the rendered manifests of an operation from the render cache,
+// running the renderer and the transformers only when it is not cached.
+func (r *HashReconciler) render(
+	ctx context.Context,
+	log logr.Logger,
+	hash *gitv1.Hash,
+	k *krusty.Kustomizer,
+	operation gitv1.Operation,
+) (resmap.ResMap, []string, []json.RawMessage, error) {
+	if r.renderCache == nil {
+		return r.build(ctx, log, hash, k, operation, "")
+	}
+	commit, cacheable, err := r.remoteCommit(ctx, hash, operation)
+	if err != nil {
+		log.Error(err, "unable to resolve the commit of the operation path", "operation", operation)
+		return nil, nil, nil, err
+	}
+	if !cacheable {
+		return r.build(ctx, log, hash, k, operation, "")
+	}
+	key, err := renderKey(hash, operation, commit)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if data, ok := r.renderCache.Get(key); ok {
+		var cached cachedRender
+		if err := json.Unmarshal(data, &cached); err == nil {
+			if m, err := resmapFactory.NewResMapFromBytes(cached.Manifests); err == nil {
+				return m, cached.Namespaces, cached.Encrypted, nil
+			}
+		}
+		log.Info("Ignoring unreadable render cache entry", "operation", operation.Name)
+	}
+	m, namespaces, encrypted, err := r.build(ctx, log, hash, k, operation, commit)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	manifests, err := m.AsYaml()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	data, err := json.Marshal(cachedRender{Namespaces: namespaces, Manifests: manifests, Encrypted: encrypted})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := r.renderCache.Put(key, data); err != nil {
+		log.Error(err, "unable to save to the render cache", "operation", operation.Name)
+	}
+	return m, namespaces, encrypted, nil
+}
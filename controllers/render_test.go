@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "github.com/slipway-gitops/slipway/api/v1"
+	"github.com/slipway-gitops/slipway/pkg/gitfetch"
+	"github.com/slipway-gitops/slipway/pkg/rendercache"
+	gitclient "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/kustomize/api/filesys"
+	"sigs.k8s.io/kustomize/api/krusty"
+)
+
+func TestRenderKey(t *testing.T) {
+	hash := &v1.Hash{}
+	hash.Name = "08c913b"
+	op := v1.Operation{
+		Name:           "app",
+		Path:           "git@github.com:slipway-gitops/slipway-example-app.git//kustomize/base",
+		ReferenceTitle: "master",
+		Transformers:   []v1.Transformer{{Type: "namespace", Value: "branch"}},
+	}
+	key, _ := renderKey(hash, op, "")
+	weighted := op
+	weighted.Weight = 5
+	if other, _ := renderKey(hash, weighted, ""); other != key {
+		t.Errorf("Expected the weight not to change the key")
+	}
+	renamed := op
+	renamed.ReferenceTitle = "feature"
+	if other, _ := renderKey(hash, renamed, ""); other == key {
+		t.Errorf("Expected the reference title to change the key")
+	}
+	if other, _ := renderKey(hash, op, "61304a0"); other == key {
+		t.Errorf("Expected the commit of the remote path to change the key")
+	}
+	hash.Spec.GitRepo = "example-app"
+	if other, _ := renderKey(hash, op, ""); other == key {
+		t.Errorf("Expected the GitRepo to change the key")
+	}
+	hash.Name = "61304a0"
+	if other, _ := renderKey(hash, op, ""); other == key {
+		t.Errorf("Expected the commit to change the key")
+	}
+}
+
+func TestRenderCache(t *testing.T) {
+	fs := filesys.MakeFsInMemory()
+	fs.WriteFile("/app/kustomization.yaml", []byte("resources:\n- cm.yaml\n"))
+	fs.WriteFile("/app/cm.yaml", []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: config\n"))
+	k := krusty.MakeKustomizer(fs, krusty.MakeDefaultOptions())
+	cache, _ := rendercache.New(10, 10, "")
+	r := &HashReconciler{renderCache: cache}
+	r.transformers, _ = r.loadTransformers(nil)
+	log := ctrl.Log.WithName("test")
+	hash := &v1.Hash{}
+	hash.Name = "08c913b"
+	op := v1.Operation{
+		Name:           "app",
+		Path:           "/app",
+		ReferenceTitle: "master",
+		Transformers:   []v1.Transformer{{Type: "namespace", Value: "branch"}},
+	}
+
+	if _, _, _, err := r.render(context.Background(), log, hash, k, op); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	// A cached render does not read the kustomization again
+	fs.RemoveAll("/app")
+	m, namespaces, _, err := r.render(context.Background(), log, hash, k, op)
+	if err != nil {
+		t.Fatalf("Expected a cached render got %v", err)
+	}
+	if len(namespaces) != 1 || namespaces[0] != "master" {
+		t.Errorf("Expected the master namespace got %v", namespaces)
+	}
+	if m.Size() != 1 || m.Resources()[0].GetNamespace() != "master" {
+		t.Errorf("Expected the transformed ConfigMap got %v", m)
+	}
+}
+
+func TestRenderCacheBranch(t *testing.T) {
+	origin, err := ioutil.TempDir("", "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(origin)
+	repo, err := gitclient.PlainInit(origin, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(name string) {
+		os.MkdirAll(filepath.Join(origin, "app"), 0755)
+		ioutil.WriteFile(filepath.Join(origin, "app", "kustomization.yaml"), []byte("resources:\n- cm.yaml\n"), 0644)
+		ioutil.WriteFile(filepath.Join(origin, "app", "cm.yaml"),
+			[]byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: "+name+"\n"), 0644)
+		if _, err := wt.Add("app"); err != nil {
+			t.Fatal(err)
+		}
+		_, err := wt.Commit("update "+name, &gitclient.CommitOptions{
+			Author: &object.Signature{Name: "Jane Doe", Email: "jane@example.com", When: time.Now()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit("first")
+
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	workspace, err := gitfetch.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, _ := rendercache.New(10, 10, "")
+	r := &HashReconciler{renderCache: cache, workspace: workspace}
+	r.transformers, _ = r.loadTransformers(nil)
+	k := krusty.MakeKustomizer(filesys.MakeFsOnDisk(), krusty.MakeDefaultOptions())
+	log := ctrl.Log.WithName("test")
+	hash := &v1.Hash{}
+	hash.Name = "08c913b"
+	// The path tracks the branch instead of the commit of the Hash
+	op := v1.Operation{Name: "app", Path: "file://" + origin + "//app?ref=master"}
+
+	m, _, _, err := r.render(context.Background(), log, hash, k, op)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if m.Size() != 1 || m.Resources()[0].GetName() != "first" {
+		t.Errorf("Expected the first ConfigMap got %v", m)
+	}
+	commit("second")
+	m, _, _, err = r.render(context.Background(), log, hash, k, op)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if m.Size() != 1 || m.Resources()[0].GetName() != "second" {
+		t.Errorf("Expected the new commit of the branch to be rendered got %v", m)
+	}
+}
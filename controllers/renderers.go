@@ -0,0 +1,455 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	jsonnet "github.com/google/go-jsonnet"
+	"sigs.k8s.io/kustomize/api/filesys"
+	"sigs.k8s.io/kustomize/api/konfig"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/resmap"
+	ktypes "sigs.k8s.io/kustomize/api/types"
+
+	gitv1 "github.com/slipway-gitops/slipway/api/v1"
+)
+
+var (
+	ErrInvalidRenderer       = errors.New("Invalid operation renderer")
+	ErrOutsideRoot           = errors.New("Path is outside of the repository")
+	ErrInvalidJsonnet        = errors.New("Jsonnet output is not an object or array of objects")
+	ErrLocalLoadRestrictions = errors.New("LoadRestrictionsNone is only supported for remote paths")
+)
+
+// renderSource renders the manifests at a local path with the renderer of the
+// operation. Files the renderer reads have to be within root.
+func (r *HashReconciler) renderSource(
+	ctx context.Context,
+	k *krusty.Kustomizer,
+	hash *gitv1.Hash,
+	operation gitv1.Operation,
+	path, root string,
+) (resmap.ResMap, error) {
+	switch operation.Renderer {
+	case "", gitv1.RendererKustomize:
+		k, err := kustomizer(k, operation.Kustomize, root)
+		if err != nil {
+			return nil, err
+		}
+		// Run Kustomize returns ResMap
+		// https://godoc.org/sigs.k8s.io/kustomize/api/resmap#ResMap
+		return k.Run(path)
+	case gitv1.RendererHelm:
+		manifests, err := r.helmTemplate(ctx, operation, path, root)
+		if err != nil {
+			return nil, err
+		}
+		m, err := resmapFactory.NewResMapFromBytes(manifests)
+		if err != nil {
+			return nil, err
+		}
+		return m, helmHooks(m)
+	case gitv1.RendererRaw:
+		return rawManifests(operation.Raw, path, root)
+	case gitv1.RendererJsonnet:
+		output, err := jsonnetEval(hash, operation, path, root)
+		if err != nil {
+			return nil, err
+		}
+		return jsonnetResources(output)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrInvalidRenderer, operation.Renderer)
+}
+
+// validateLocal fails for the options of an operation that need the root of a
+// repository, which local paths do not have.
+func validateLocal(operation gitv1.Operation) error {
+	if operation.Kustomize != nil && operation.Kustomize.LoadRestrictor == gitv1.LoadRestrictionsNone {
+		return fmt.Errorf("%w: %s", ErrLocalLoadRestrictions, operation.Path)
+	}
+	return nil
+}
+
+// kustomizer returns a kustomizer with the build options of an operation,
+// the default kustomizer k is used without options.
+func kustomizer(k *krusty.Kustomizer, options *gitv1.KustomizeOptions, root string) (*krusty.Kustomizer, error) {
+	if options == nil {
+		return k, nil
+	}
+	opts := krusty.MakeDefaultOptions()
+	fs := filesys.MakeFsOnDisk()
+	if options.LoadRestrictor == gitv1.LoadRestrictionsNone {
+		// Files outside the kustomization still have to be in the repository
+		opts.LoadRestrictions = ktypes.LoadRestrictionsNone
+		fs = rootedFS{FileSystem: fs, root: root}
+	}
+	if options.EnablePlugins {
+		config, err := konfig.EnabledPluginConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.PluginConfig = config
+	}
+	return krusty.MakeKustomizer(fs, opts), nil
+}
+
+// rootedFS is a file system that only reads files within root and the
+// clones kustomize makes of remote bases.
+type rootedFS struct {
+	filesys.FileSystem
+	root string
+}
+
+// allowed fails for paths outside root and the kustomize clones.
+func (fs rootedFS) allowed(path string) error {
+	_, err := withinRoot(fs.root, path)
+	if !errors.Is(err, ErrOutsideRoot) {
+		return err
+	}
+	if clone, cloneErr := withinRoot(os.TempDir(), path); cloneErr == nil {
+		if rel, _ := filepath.Rel(os.TempDir(), clone); strings.HasPrefix(rel, "kustomize-") {
+			return nil
+		}
+	}
+	return err
+}
+
+// Open opens a file within root.
+func (fs rootedFS) Open(path string) (filesys.File, error) {
+	if err := fs.allowed(path); err != nil {
+		return nil, err
+	}
+	return fs.FileSystem.Open(path)
+}
+
+// ReadFile reads a file within root.
+func (fs rootedFS) ReadFile(path string) ([]byte, error) {
+	if err := fs.allowed(path); err != nil {
+		return nil, err
+	}
+	return fs.FileSystem.ReadFile(path)
+}
+
+// helmTemplate renders the chart at path with helm template.
+func (r *HashReconciler) helmTemplate(ctx context.Context, operation gitv1.Operation, path, root string) ([]byte, error) {
+	helm := operation.Helm
+	if helm == nil {
+		helm = &gitv1.HelmSource{}
+	}
+	release := helm.ReleaseName
+	if release == "" {
+		release = operation.Name
+	}
+	args := []string{"template", release, path}
+	if operation.Namespace != "" {
+		args = append(args, "--namespace", operation.Namespace)
+	}
+	for _, f := range helm.ValuesFiles {
+		values, err := withinRoot(root, filepath.Join(path, filepath.FromSlash(f)))
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--values", values)
+	}
+	if helm.Values != "" {
+		f, err := ioutil.TempFile("", "values-*.yaml")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(f.Name())
+		if _, err := f.WriteString(helm.Values); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Close(); err != nil {
+			return nil, err
+		}
+		args = append(args, "--values", f.Name())
+	}
+	return runBinary(ctx, r.HelmBinary, args...)
+}
+
+// Annotations of helm chart hooks
+const (
+	helmHookAnnotation             = "helm.sh/hook"
+	helmHookDeletePolicyAnnotation = "helm.sh/hook-delete-policy"
+)
+
+// helmHookTypes maps the helm hooks to the hooks of Slipway, hooks missing
+// here such as tests, post-delete and rollbacks have no equivalent.
+var helmHookTypes = map[string]gitv1.HookType{
+	"pre-install":  gitv1.HookPreApply,
+	"pre-upgrade":  gitv1.HookPreApply,
+	"post-install": gitv1.HookPostApply,
+	"post-upgrade": gitv1.HookPostApply,
+	"pre-delete":   gitv1.HookPreDelete,
+}
+
+// helmHooks turns the hook Jobs of a chart into Slipway hooks. Hooks without
+// an equivalent, such as test Pods, are dropped, other hooked objects are
+// applied like the rest of the chart.
+func helmHooks(m resmap.ResMap) error {
+	for _, res := range m.Resources() {
+		annotations := res.GetAnnotations()
+		value, ok := annotations[helmHookAnnotation]
+		if !ok {
+			continue
+		}
+		var types []string
+		for _, t := range strings.Split(value, ",") {
+			hookType, ok := helmHookTypes[strings.TrimSpace(t)]
+			if ok && !containsString(types, string(hookType)) {
+				types = append(types, string(hookType))
+			}
+		}
+		if len(types) == 0 {
+			if err := m.Remove(res.CurId()); err != nil {
+				return err
+			}
+			continue
+		}
+		if res.GetGvk().Group != "batch" || res.GetGvk().Kind != "Job" {
+			continue
+		}
+		annotations[HookAnnotation] = strings.Join(types, ",")
+		if policy, ok := annotations[helmHookDeletePolicyAnnotation]; ok {
+			annotations[HookDeletePolicyAnnotation] = policy
+		}
+		res.SetAnnotations(annotations)
+	}
+	return nil
+}
+
+// Files loaded by the raw renderer when no include globs are set
+var rawIncludeDefault = []string{"*.yaml", "*.yml", "*.json"}
+
+// rawManifests loads the manifest files under path matching the globs.
+func rawManifests(raw *gitv1.RawSource, path, root string) (resmap.ResMap, error) {
+	if raw == nil {
+		raw = &gitv1.RawSource{}
+	}
+	include := raw.Include
+	if len(include) == 0 {
+		include = rawIncludeDefault
+	}
+	m := resmap.New()
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(path, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !matchesFile(include, rel) || matchesFile(raw.Exclude, rel) {
+			return nil
+		}
+		// Symlinks may point out of the repository
+		if file, err = withinRoot(root, file); err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		resources, err := resmapFactory.NewResMapFromBytes(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+		return m.AppendAll(resources)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// matchesFile reports if a slash separated relative path matches one of the
+// globs, globs without a slash are also matched against the file name.
+func matchesFile(globs []string, rel string) bool {
+	for _, g := range globs {
+		if matchesAny([]string{g}, rel) {
+			return true
+		}
+		if !strings.Contains(g, "/") && matchesAny([]string{g}, path.Base(rel)) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonnetEval evaluates the jsonnet file of an operation with the reference
+// as external variables. Imports are confined to root.
+func jsonnetEval(hash *gitv1.Hash, operation gitv1.Operation, path, root string) ([]byte, error) {
+	source := operation.Jsonnet
+	if source == nil {
+		source = &gitv1.JsonnetSource{}
+	}
+	file := source.File
+	if file == "" {
+		file = "main.jsonnet"
+	}
+	file, err := withinRoot(root, filepath.Join(path, filepath.FromSlash(file)))
+	if err != nil {
+		return nil, err
+	}
+	snippet, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	importer := &rootedImporter{root: root}
+	for _, lib := range source.LibPaths {
+		dir, err := withinRoot(root, filepath.Join(path, filepath.FromSlash(lib)))
+		if err != nil {
+			return nil, err
+		}
+		importer.JPaths = append(importer.JPaths, dir)
+	}
+	vm := jsonnet.MakeVM()
+	vm.Importer(importer)
+	vm.ExtVar("commit", hash.Name)
+	vm.ExtVar("referenceTitle", operation.ReferenceTitle)
+	vm.ExtVar("opType", string(operation.Type))
+	vm.ExtVar("gitRepo", hash.Spec.GitRepo)
+	output, err := vm.EvaluateSnippet(file, string(snippet))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(output), nil
+}
+
+// rootedImporter imports jsonnet files like the jsonnet command, failing for
+// imports outside root such as absolute paths or paths climbing out with "..".
+type rootedImporter struct {
+	jsonnet.FileImporter
+	root string
+}
+
+// Import imports a file within root.
+func (i *rootedImporter) Import(importedFrom, importedPath string) (jsonnet.Contents, string, error) {
+	contents, foundAt, err := i.FileImporter.Import(importedFrom, importedPath)
+	if err != nil {
+		return jsonnet.Contents{}, "", err
+	}
+	if _, err := withinRoot(i.root, foundAt); err != nil {
+		return jsonnet.Contents{}, "", err
+	}
+	return contents, foundAt, nil
+}
+
+// jsonnetResources converts jsonnet output to resources. The output may be
+// an object, a List, an array or an object of named objects, nested freely.
+func jsonnetResources(output []byte) (resmap.ResMap, error) {
+	var value interface{}
+	if err := json.Unmarshal(output, &value); err != nil {
+		return nil, err
+	}
+	m := resmap.New()
+	var add func(v interface{}) error
+	add = func(v interface{}) error {
+		switch val := v.(type) {
+		case []interface{}:
+			for _, item := range val {
+				if err := add(item); err != nil {
+					return err
+				}
+			}
+		case map[string]interface{}:
+			if _, ok := val["kind"]; !ok {
+				keys := make([]string, 0, len(val))
+				for key := range val {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				for _, key := range keys {
+					if err := add(val[key]); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			if items, ok := val["items"]; ok && val["kind"] == "List" {
+				return add(items)
+			}
+			data, err := json.Marshal(val)
+			if err != nil {
+				return err
+			}
+			resources, err := resmapFactory.NewResMapFromBytes(data)
+			if err != nil {
+				return err
+			}
+			return m.AppendAll(resources)
+		case nil:
+		default:
+			return fmt.Errorf("%w: %v", ErrInvalidJsonnet, v)
+		}
+		return nil
+	}
+	if err := add(value); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// withinRoot returns the path with symlinks resolved, it fails when the path
+// is outside of root.
+func withinRoot(root, path string) (string, error) {
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s", ErrOutsideRoot, path)
+	}
+	return resolved, nil
+}
+
+// runBinary runs a renderer binary and returns its output, the error
+// includes what the binary wrote to stderr.
+func runBinary(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return runCommand(exec.CommandContext(ctx, name, args...))
+}
+
+// runCommand runs a command and returns its output, the error includes what
+// the command wrote to stderr.
+func runCommand(cmd *exec.Cmd) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s %s: %w: %s", cmd.Args[0], cmd.Args[1], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,298 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "github.com/slipway-gitops/slipway/api/v1"
+	"sigs.k8s.io/kustomize/api/filesys"
+	"sigs.k8s.io/kustomize/api/krusty"
+)
+
+// fakeBinary writes a script that records its arguments and prints output.
+func fakeBinary(t *testing.T, dir, name, output string) string {
+	path := filepath.Join(dir, name)
+	script := "#!/bin/sh\necho \"$@\" > " + path + ".args\ncat <<'EOF'\n" + output + "EOF\n"
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHelmRenderer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "repo")
+	chart := filepath.Join(root, "charts", "app")
+	os.MkdirAll(chart, 0755)
+	ioutil.WriteFile(filepath.Join(root, "charts", "prod.yaml"), []byte("replicas: 3\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "secret.yaml"), []byte("password: x\n"), 0644)
+
+	helm := fakeBinary(t, dir, "helm", `---
+# Source: app/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+---
+# Source: app/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+`)
+	r := &HashReconciler{HelmBinary: helm}
+	op := v1.Operation{
+		Name:      "app",
+		Renderer:  v1.RendererHelm,
+		Namespace: "apps",
+		Helm: &v1.HelmSource{
+			ValuesFiles: []string{"../prod.yaml"},
+			Values:      "image: app:v1\n",
+		},
+	}
+	m, err := r.renderSource(context.Background(), nil, &v1.Hash{}, op, chart, root)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if m.Size() != 2 {
+		t.Errorf("Expected 2 resources got %d", m.Size())
+	}
+	args, _ := ioutil.ReadFile(helm + ".args")
+	expected := "template app " + chart + " --namespace apps --values " + filepath.Join(root, "charts", "prod.yaml") + " --values "
+	if !strings.HasPrefix(string(args), expected) {
+		t.Errorf("Expected args %q got %q", expected, args)
+	}
+
+	op.Helm.ValuesFiles = []string{"../../../secret.yaml"}
+	if _, err := r.renderSource(context.Background(), nil, &v1.Hash{}, op, chart, root); !errors.Is(err, ErrOutsideRoot) {
+		t.Errorf("Expected a values file outside the repository to fail got %v", err)
+	}
+	op.Renderer = "jinja"
+	if _, err := r.renderSource(context.Background(), nil, &v1.Hash{}, op, chart, root); !errors.Is(err, ErrInvalidRenderer) {
+		t.Errorf("Expected an invalid renderer error got %v", err)
+	}
+}
+
+func TestHelmHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	helm := fakeBinary(t, dir, "helm", `---
+# Source: app/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+  annotations:
+    helm.sh/hook: pre-install
+---
+# Source: app/templates/migrate.yaml
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+  annotations:
+    helm.sh/hook: pre-install,pre-upgrade
+    helm.sh/hook-delete-policy: hook-succeeded
+---
+# Source: app/templates/tests/test-connection.yaml
+apiVersion: v1
+kind: Pod
+metadata:
+  name: app-test-connection
+  annotations:
+    helm.sh/hook: test
+`)
+	r := &HashReconciler{HelmBinary: helm}
+	op := v1.Operation{Name: "app", Renderer: v1.RendererHelm}
+	m, err := r.renderSource(context.Background(), nil, &v1.Hash{}, op, dir, dir)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	objs, err := decodeResources(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks, objects, err := splitHooks(objs)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(objects) != 1 || objects[0].GetKind() != "ConfigMap" {
+		t.Errorf("Expected only the ConfigMap to be applied got %v", objects)
+	}
+	if len(hooks) != 1 || !hooks[0].is(v1.HookPreApply) || !hooks[0].deletedOn(hookSucceeded) || hooks[0].deletedOn(hookBeforeCreation) {
+		t.Errorf("Expected the migrate Job as a pre-apply hook got %v", hooks)
+	}
+}
+
+func TestRawRenderer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	deploy := filepath.Join(dir, "deploy")
+	os.MkdirAll(filepath.Join(deploy, "db"), 0755)
+	os.MkdirAll(filepath.Join(deploy, "tests"), 0755)
+	ioutil.WriteFile(filepath.Join(deploy, "configmap.yaml"), []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n---\napiVersion: v1\nkind: Service\nmetadata:\n  name: app\n"), 0644)
+	ioutil.WriteFile(filepath.Join(deploy, "db", "service.json"), []byte(`{"apiVersion": "v1", "kind": "Service", "metadata": {"name": "db"}}`), 0644)
+	ioutil.WriteFile(filepath.Join(deploy, "tests", "pod.yml"), []byte("apiVersion: v1\nkind: Pod\nmetadata:\n  name: test\n"), 0644)
+	ioutil.WriteFile(filepath.Join(deploy, "README.md"), []byte("# deploy\n"), 0644)
+
+	tests := []struct {
+		name  string
+		raw   *v1.RawSource
+		names []string
+	}{
+		{"defaults", nil, []string{"ConfigMap/app", "Service/app", "Service/db", "Pod/test"}},
+		{"exclude", &v1.RawSource{Exclude: []string{"tests/*"}}, []string{"ConfigMap/app", "Service/app", "Service/db"}},
+		{"include", &v1.RawSource{Include: []string{"*.json"}}, []string{"Service/db"}},
+		{"include path", &v1.RawSource{Include: []string{"db/*", "tests/*"}, Exclude: []string{"*.yml"}}, []string{"Service/db"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op := v1.Operation{Name: "app", Renderer: v1.RendererRaw, Raw: tt.raw}
+			m, err := (&HashReconciler{}).renderSource(context.Background(), nil, &v1.Hash{}, op, deploy, dir)
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			var names []string
+			for _, res := range m.Resources() {
+				names = append(names, res.GetKind()+"/"+res.GetName())
+			}
+			if strings.Join(names, ",") != strings.Join(tt.names, ",") {
+				t.Errorf("Expected %v got %v", tt.names, names)
+			}
+		})
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "secret.yaml"), []byte("apiVersion: v1\nkind: Secret\nmetadata:\n  name: x\n"), 0644)
+	os.Symlink(filepath.Join(dir, "secret.yaml"), filepath.Join(deploy, "secret.yaml"))
+	op := v1.Operation{Name: "app", Renderer: v1.RendererRaw}
+	if _, err := (&HashReconciler{}).renderSource(context.Background(), nil, &v1.Hash{}, op, deploy, deploy); !errors.Is(err, ErrOutsideRoot) {
+		t.Errorf("Expected a symlink out of the repository to fail got %v", err)
+	}
+}
+
+func TestJsonnetRenderer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "repo")
+	platform := filepath.Join(root, "platform")
+	os.MkdirAll(filepath.Join(root, "lib"), 0755)
+	os.MkdirAll(platform, 0755)
+	ioutil.WriteFile(filepath.Join(root, "lib", "service.libsonnet"),
+		[]byte(`function(name) {apiVersion: "v1", kind: "Service", metadata: {name: name}}`), 0644)
+	ioutil.WriteFile(filepath.Join(platform, "main.jsonnet"), []byte(`local service = import "service.libsonnet";
+{
+  app: [
+    {apiVersion: "v1", kind: "ConfigMap", metadata: {name: "app"},
+     data: {commit: std.extVar("commit"), ref: std.extVar("referenceTitle"),
+            type: std.extVar("opType"), repo: std.extVar("gitRepo")}},
+    {apiVersion: "v1", kind: "List", items: [service("app")]},
+  ],
+  db: service("db"),
+  disabled: null,
+}
+`), 0644)
+
+	r := &HashReconciler{}
+	hash := &v1.Hash{}
+	hash.Name = "08c913b"
+	hash.Spec.GitRepo = "platform"
+	op := v1.Operation{
+		Name:           "platform",
+		Renderer:       v1.RendererJsonnet,
+		Type:           "branch",
+		ReferenceTitle: "master",
+		Jsonnet:        &v1.JsonnetSource{LibPaths: []string{"../lib"}},
+	}
+	m, err := r.renderSource(context.Background(), nil, hash, op, platform, root)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	var names []string
+	for _, res := range m.Resources() {
+		names = append(names, res.GetKind()+"/"+res.GetName())
+	}
+	if strings.Join(names, ",") != "ConfigMap/app,Service/app,Service/db" {
+		t.Errorf("Expected the nested objects got %v", names)
+	}
+	data, _ := m.Resources()[0].GetFieldValue("data")
+	expected := map[string]interface{}{"commit": "08c913b", "ref": "master", "type": "branch", "repo": "platform"}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("Expected the external variables %v got %v", expected, data)
+	}
+
+	// Imports cannot read files outside the repository
+	ioutil.WriteFile(filepath.Join(dir, "token"), []byte("secret"), 0644)
+	for _, imported := range []string{filepath.Join(dir, "token"), "../../token"} {
+		ioutil.WriteFile(filepath.Join(platform, "main.jsonnet"), []byte(`{token: importstr "`+imported+`"}`), 0644)
+		if _, err := r.renderSource(context.Background(), nil, hash, op, platform, root); err == nil ||
+			!strings.Contains(err.Error(), ErrOutsideRoot.Error()) {
+			t.Errorf("Expected the import of %s to fail got %v", imported, err)
+		}
+	}
+
+	if _, err := jsonnetResources([]byte(`["app"]`)); !errors.Is(err, ErrInvalidJsonnet) {
+		t.Errorf("Expected an invalid jsonnet output error got %v", err)
+	}
+}
+
+func TestKustomizeOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kustomize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "repo")
+	overlay := filepath.Join(root, "overlays", "prod")
+	os.MkdirAll(overlay, 0755)
+	os.MkdirAll(filepath.Join(root, "shared"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "shared", "configmap.yaml"), []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: shared\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "secret.yaml"), []byte("apiVersion: v1\nkind: Secret\nmetadata:\n  name: host\n"), 0644)
+
+	k := krusty.MakeKustomizer(filesys.MakeFsOnDisk(), krusty.MakeDefaultOptions())
+	r := &HashReconciler{}
+	op := v1.Operation{Name: "app"}
+	ioutil.WriteFile(filepath.Join(overlay, "kustomization.yaml"), []byte("resources:\n- ../../shared/configmap.yaml\n"), 0644)
+	if _, err := r.renderSource(context.Background(), k, &v1.Hash{}, op, overlay, root); err == nil {
+		t.Errorf("Expected files outside the kustomization to fail by default")
+	}
+	op.Kustomize = &v1.KustomizeOptions{LoadRestrictor: v1.LoadRestrictionsNone}
+	m, err := r.renderSource(context.Background(), k, &v1.Hash{}, op, overlay, root)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if m.Size() != 1 || m.Resources()[0].GetName() != "shared" {
+		t.Errorf("Expected the shared ConfigMap got %v", m)
+	}
+	ioutil.WriteFile(filepath.Join(overlay, "kustomization.yaml"), []byte("resources:\n- ../../../secret.yaml\n"), 0644)
+	if _, err := r.renderSource(context.Background(), k, &v1.Hash{}, op, overlay, root); err == nil ||
+		!strings.Contains(err.Error(), ErrOutsideRoot.Error()) {
+		t.Errorf("Expected files outside the repository to fail got %v", err)
+	}
+	op.Path = overlay
+	if err := validateLocal(op); !errors.Is(err, ErrLocalLoadRestrictions) {
+		t.Errorf("Expected LoadRestrictionsNone to fail for local paths got %v", err)
+	}
+	op.Kustomize.LoadRestrictor = v1.LoadRestrictionsRootOnly
+	if err := validateLocal(op); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"k8s.io/apimachinery/pkg/api/meta"
+	unstruct "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// Namespace for namespaced objects when neither the object nor the operation sets one
+const defaultNamespace = "default"
+
+// setScope namespaces an object according to its scope in the RESTMapper.
+// Cluster-scoped objects have their namespace removed, namespaced objects
+// without a namespace are put in the namespace given or the default namespace.
+// Kinds the RESTMapper does not know yet, or could not reload, take the scope of the
+// CustomResourceDefinition defining them in kinds, or are treated as namespaced.
+func setScope(
+	mapper meta.RESTMapper,
+	kinds map[schema.GroupKind]*unstruct.Unstructured,
+	u *unstruct.Unstructured,
+	namespace string,
+) error {
+	gvk := u.GroupVersionKind()
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	_, limited := apiutil.DelayIfRateLimited(err)
+	switch {
+	case meta.IsNoMatchError(err) || limited:
+		if crd, ok := kinds[gvk.GroupKind()]; ok {
+			if scope, _, _ := unstruct.NestedString(crd.Object, "spec", "scope"); scope == "Cluster" {
+				u.SetNamespace("")
+				return nil
+			}
+		}
+	case err != nil:
+		return err
+	case mapping.Scope.Name() == meta.RESTScopeNameRoot:
+		u.SetNamespace("")
+		return nil
+	}
+	if u.GetNamespace() != "" {
+		return nil
+	}
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	u.SetNamespace(namespace)
+	return nil
+}
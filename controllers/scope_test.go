@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	gitv1 "github.com/slipway-gitops/slipway/api/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	unstruct "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestSetScope(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRole"}, meta.RESTScopeRoot)
+
+	tests := []struct {
+		name       string
+		apiVersion string
+		kind       string
+		namespace  string
+		operation  string
+		expected   string
+	}{
+		{"namespaced default", "v1", "ConfigMap", "", "", "default"},
+		{"namespaced operation", "v1", "ConfigMap", "", "apps", "apps"},
+		{"namespaced object", "v1", "ConfigMap", "kept", "apps", "kept"},
+		{"cluster scoped", "rbac.authorization.k8s.io/v1", "ClusterRole", "", "apps", ""},
+		{"cluster scoped namespaced", "rbac.authorization.k8s.io/v1", "ClusterRole", "master", "apps", ""},
+		{"unknown kind", "example.com/v1", "Widget", "", "apps", "apps"},
+		{"defined cluster kind", "example.com/v1", "Gadget", "master", "apps", ""},
+	}
+	crd := newObject("apiextensions.k8s.io/v1", "CustomResourceDefinition", map[string]interface{}{
+		"spec": map[string]interface{}{
+			"group": "example.com",
+			"scope": "Cluster",
+			"names": map[string]interface{}{"kind": "Gadget"},
+		},
+	})
+	kinds := definedKinds([]*unstruct.Unstructured{crd})
+
+	for _, tt := range tests {
+		u := newObject(tt.apiVersion, tt.kind, nil)
+		u.SetNamespace(tt.namespace)
+		if err := setScope(mapper, kinds, u, tt.operation); err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if u.GetNamespace() != tt.expected {
+			t.Errorf("%s: expected namespace %q got %q", tt.name, tt.expected, u.GetNamespace())
+		}
+	}
+}
+
+func TestOperationNamespaces(t *testing.T) {
+	tests := []struct {
+		name       string
+		namespace  string
+		namespaces []string
+		expected   []string
+	}{
+		{"no namespace", "", []string{"team"}, []string{"team"}},
+		{"default namespace", "default", nil, nil},
+		{"operation namespace", "apps", []string{"team"}, []string{"team", "apps"}},
+		{"transformer namespace", "apps", []string{"apps"}, []string{"apps"}},
+	}
+	for _, tt := range tests {
+		got := operationNamespaces(gitv1.Operation{Namespace: tt.namespace}, tt.namespaces)
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: expected %v got %v", tt.name, tt.expected, got)
+		}
+	}
+}
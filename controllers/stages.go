@@ -0,0 +1,163 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	unstruct "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	gitv1 "github.com/slipway-gitops/slipway/api/v1"
+)
+
+var (
+	// How long a stage may wait on its objects when the operations have no timeout
+	defaultStageTimeout = 5 * time.Minute
+	// How often a progressing stage is checked again
+	stageRequeue = 10 * time.Second
+)
+
+// operationStage is a group of operations sharing a weight.
+type operationStage struct {
+	Weight     int64
+	Timeout    time.Duration
+	Operations []gitv1.Operation
+}
+
+// operationStages groups operations by weight, lowest weight first.
+// The timeout of a stage is the longest timeout of its operations, operations
+// without a timeout count as defaultStageTimeout.
+func operationStages(operations []gitv1.Operation) []operationStage {
+	sorted := make([]gitv1.Operation, len(operations))
+	copy(sorted, operations)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Weight < sorted[j].Weight
+	})
+	var stages []operationStage
+	for _, op := range sorted {
+		if len(stages) == 0 || stages[len(stages)-1].Weight != op.Weight {
+			stages = append(stages, operationStage{Weight: op.Weight})
+		}
+		stage := &stages[len(stages)-1]
+		timeout := defaultStageTimeout
+		if op.Timeout != nil {
+			timeout = op.Timeout.Duration
+		}
+		if timeout > stage.Timeout {
+			stage.Timeout = timeout
+		}
+		stage.Operations = append(stage.Operations, op)
+	}
+	return stages
+}
+
+// objectsHealth returns the health of the first object that is not healthy,
+// with a message naming the object.
+func objectsHealth(objs []*unstruct.Unstructured) (gitv1.HealthStatus, string) {
+	for _, u := range objs {
+		health, message := objectHealth(u)
+		if health == gitv1.HealthHealthy {
+			continue
+		}
+		return health, fmt.Sprintf("Kind:%s Named:%s %s", u.GetKind(), u.GetName(), message)
+	}
+	return gitv1.HealthHealthy, ""
+}
+
+// previousStages returns the stage statuses of the last reconcile. A changed
+// spec starts over, the stages of a new generation restart their timeouts.
+func previousStages(hash *gitv1.Hash) []gitv1.StageStatus {
+	if hash.Generation != hash.Status.ObservedGeneration {
+		return nil
+	}
+	return hash.Status.Stages
+}
+
+// newStageStatus determines the phase of a stage from the health of its objects
+// and hooks. The start time of a stage is kept from its previous status, unless
+// the stage was ready before and is now rolling out again.
+func newStageStatus(
+	stage operationStage,
+	previous []gitv1.StageStatus,
+	health gitv1.HealthStatus,
+	message string,
+	now metav1.Time,
+) gitv1.StageStatus {
+	status := gitv1.StageStatus{
+		Weight:    stage.Weight,
+		Phase:     gitv1.StageReady,
+		StartTime: &now,
+		Message:   message,
+	}
+	var wasReady bool
+	for _, p := range previous {
+		if p.Weight == stage.Weight && p.StartTime != nil {
+			status.StartTime = p.StartTime
+			wasReady = p.Phase == gitv1.StageReady
+		}
+	}
+	switch health {
+	case gitv1.HealthHealthy:
+		return status
+	case gitv1.HealthDegraded:
+		status.Phase = gitv1.StageFailed
+		return status
+	}
+	status.Phase = gitv1.StageProgressing
+	if wasReady {
+		status.StartTime = &now
+	}
+	if now.Sub(status.StartTime.Time) > stage.Timeout {
+		status.Phase = gitv1.StageFailed
+		status.Message = fmt.Sprintf("timed out after %s waiting on %s", stage.Timeout, status.Message)
+	}
+	return status
+}
+
+// containsObjectReference reports if the object is in the list of references.
+func containsObjectReference(refs []corev1.ObjectReference, obj corev1.ObjectReference) bool {
+	for _, r := range refs {
+		if r.Kind == obj.Kind &&
+			r.Name == obj.Name &&
+			r.Namespace == obj.Namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeObjectReferences adds the old references that are not already present.
+func mergeObjectReferences(refs, old []corev1.ObjectReference) []corev1.ObjectReference {
+	for _, obj := range old {
+		if !containsObjectReference(refs, obj) {
+			refs = append(refs, obj)
+		}
+	}
+	return refs
+}
+
+// mergeClusterObjects adds the old references of every cluster that are not already present.
+func mergeClusterObjects(hash *gitv1.Hash, old map[string][]corev1.ObjectReference) {
+	for key, refs := range old {
+		if merged := mergeObjectReferences(objectReferences(hash, key), refs); len(merged) > 0 {
+			setObjectReferences(hash, key, merged)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	v1 "github.com/slipway-gitops/slipway/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	unstruct "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestOperationStages(t *testing.T) {
+	stages := operationStages([]v1.Operation{
+		v1.Operation{Name: "app", Weight: 2},
+		v1.Operation{Name: "migrate", Weight: 1, Timeout: &metav1.Duration{Duration: time.Minute}},
+		v1.Operation{Name: "worker", Weight: 2, Timeout: &metav1.Duration{Duration: 10 * time.Minute}},
+	})
+	if len(stages) != 2 {
+		t.Fatalf("Expected 2 stages got %d", len(stages))
+	}
+	if stages[0].Weight != 1 || stages[0].Operations[0].Name != "migrate" {
+		t.Errorf("Expected migrate to be the first stage got %v", stages[0])
+	}
+	if stages[0].Timeout != time.Minute {
+		t.Errorf("Expected stage timeout of 1m got %s", stages[0].Timeout)
+	}
+	if len(stages[1].Operations) != 2 || stages[1].Timeout != 10*time.Minute {
+		t.Errorf("Expected two operations with a 10m timeout got %v", stages[1])
+	}
+}
+
+func TestOperationStagesTimeoutOrder(t *testing.T) {
+	short := &metav1.Duration{Duration: time.Minute}
+	orders := [][]v1.Operation{
+		{{Name: "default"}, {Name: "short", Timeout: short}},
+		{{Name: "short", Timeout: short}, {Name: "default"}},
+	}
+	for _, operations := range orders {
+		stages := operationStages(operations)
+		if len(stages) != 1 || stages[0].Timeout != defaultStageTimeout {
+			t.Errorf("Expected a stage timeout of %s for %s then %s got %v",
+				defaultStageTimeout, operations[0].Name, operations[1].Name, stages)
+		}
+	}
+}
+
+func TestNewStageStatus(t *testing.T) {
+	stage := operationStage{Weight: 1, Timeout: time.Minute}
+	job := &unstruct.Unstructured{}
+	job.SetAPIVersion("batch/v1")
+	job.SetKind("Job")
+	job.SetName("migrate")
+	now := metav1.Now()
+
+	health, message := objectsHealth([]*unstruct.Unstructured{job})
+	status := newStageStatus(stage, nil, health, message, now)
+	if status.Phase != v1.StageProgressing {
+		t.Errorf("Expected Progressing got %s", status.Phase)
+	}
+
+	started := metav1.NewTime(now.Add(-2 * time.Minute))
+	previous := []v1.StageStatus{
+		v1.StageStatus{Weight: 1, Phase: v1.StageProgressing, StartTime: &started},
+	}
+	status = newStageStatus(stage, previous, health, message, now)
+	if status.Phase != v1.StageFailed {
+		t.Errorf("Expected timed out stage to be Failed got %s", status.Phase)
+	}
+
+	previous[0].Phase = v1.StageReady
+	status = newStageStatus(stage, previous, health, message, now)
+	if status.Phase != v1.StageProgressing || !status.StartTime.Equal(&now) {
+		t.Errorf("Expected a ready stage to restart its timeout got %v", status)
+	}
+
+	unstruct.SetNestedSlice(job.Object, []interface{}{
+		map[string]interface{}{"type": "Complete", "status": "True"},
+	}, "status", "conditions")
+	health, message = objectsHealth([]*unstruct.Unstructured{job})
+	status = newStageStatus(stage, nil, health, message, now)
+	if status.Phase != v1.StageReady {
+		t.Errorf("Expected Ready got %s", status.Phase)
+	}
+
+	status = newStageStatus(stage, nil, v1.HealthDegraded, "hook failed", now)
+	if status.Phase != v1.StageFailed {
+		t.Errorf("Expected Degraded to fail the stage got %s", status.Phase)
+	}
+}
+
+func TestPreviousStages(t *testing.T) {
+	stage := operationStage{Weight: 1, Timeout: time.Minute}
+	now := metav1.Now()
+	started := metav1.NewTime(now.Add(-2 * time.Minute))
+	hash := &v1.Hash{}
+	hash.Generation = 2
+	hash.Status.ObservedGeneration = 2
+	hash.Status.Stages = []v1.StageStatus{
+		v1.StageStatus{Weight: 1, Phase: v1.StageFailed, StartTime: &started},
+	}
+	status := newStageStatus(stage, previousStages(hash), v1.HealthProgressing, "waiting", now)
+	if status.Phase != v1.StageFailed {
+		t.Errorf("Expected the stage to keep its timeout got %v", status)
+	}
+
+	hash.Generation = 3
+	status = newStageStatus(stage, previousStages(hash), v1.HealthProgressing, "waiting", now)
+	if status.Phase != v1.StageProgressing || !status.StartTime.Equal(&now) {
+		t.Errorf("Expected a new generation to restart the timeout got %v", status)
+	}
+}
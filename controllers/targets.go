@@ -0,0 +1,364 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	unstruct "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	controllerutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	gitv1 "github.com/slipway-gitops/slipway/api/v1"
+)
+
+const (
+	// HashLabel marks objects in remote clusters with the Hash that owns them,
+	// owner references cannot point across clusters.
+	HashLabel = "git.gitops.slipway.org/hash"
+	// TargetFinalizer holds a deleted Hash until its objects in remote clusters are removed.
+	TargetFinalizer = "git.gitops.slipway.org/targets"
+
+	// Key of the kubeconfig in a target Secret when none is set
+	defaultKubeconfigKey = "kubeconfig"
+)
+
+var (
+	ErrInvalidTarget = errors.New("Invalid target")
+	ErrNoKubeconfig  = errors.New("No kubeconfig in target Secret")
+	// ServiceAccounts are given as namespace/name
+	ErrInvalidServiceAccount = errors.New("Invalid ServiceAccount")
+)
+
+// cluster is a cluster objects are applied to.
+type cluster struct {
+	client.Client
+	// Key of the target, empty for the cluster Slipway runs in
+	Key    string
+	mapper meta.RESTMapper
+	watch  func(*unstruct.Unstructured, *gitv1.Hash) error
+	// resourceVersion of the Secret the cluster was built from
+	version string
+	stop    chan struct{}
+}
+
+// own marks the object as owned by the Hash, objects in the cluster Slipway
+// runs in get a controller reference and objects in remote clusters a label.
+func (c *cluster) own(hash *gitv1.Hash, u *unstruct.Unstructured, scheme *runtime.Scheme) error {
+	if c.Key == "" {
+		return controllerutil.SetControllerReference(hash, u, scheme)
+	}
+	labels := u.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[HashLabel] = hash.Name
+	u.SetLabels(labels)
+	return nil
+}
+
+// owns reports if the object is owned by the Hash.
+func (c *cluster) owns(hash *gitv1.Hash, u *unstruct.Unstructured) bool {
+	if c.Key == "" {
+		return metav1.IsControlledBy(u, hash)
+	}
+	return u.GetLabels()[HashLabel] == hash.Name
+}
+
+// targetKey identifies the cluster of a target, empty for the cluster Slipway runs in.
+func targetKey(target *gitv1.Target) string {
+	if target == nil {
+		return ""
+	}
+	key := fmt.Sprintf("%s/%s", target.Namespace, target.Name)
+	if target.Key != "" && target.Key != defaultKubeconfigKey {
+		key = fmt.Sprintf("%s:%s", key, target.Key)
+	}
+	return key
+}
+
+// keyTarget is the reverse of targetKey.
+func keyTarget(key string) (*gitv1.Target, error) {
+	if key == "" {
+		return nil, nil
+	}
+	target := &gitv1.Target{}
+	if i := strings.Index(key, ":"); i >= 0 {
+		key, target.Key = key[:i], key[i+1:]
+	}
+	parts := strings.Split(key, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTarget, key)
+	}
+	target.Namespace, target.Name = parts[0], parts[1]
+	return target, nil
+}
+
+// clusterFor returns the cluster of a target. Remote clusters are built from
+// the kubeconfig in the target Secret and kept until the Secret changes.
+// When the Hash has a ServiceAccount its client impersonates it, watches are
+// always made by Slipway itself.
+func (r *HashReconciler) clusterFor(
+	ctx context.Context,
+	log logr.Logger,
+	hash *gitv1.Hash,
+	target *gitv1.Target,
+) (*cluster, error) {
+	key := targetKey(target)
+	username, err := serviceAccountUsername(hash.Spec.ServiceAccountName)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" && username == "" {
+		return &cluster{
+			Client: r.Client,
+			mapper: r.restMapper,
+			watch:  r.watcher,
+		}, nil
+	}
+	if target != nil && (target.Name == "" || target.Namespace == "") {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTarget, key)
+	}
+	var secret corev1.Secret
+	if target != nil {
+		if err := r.Get(ctx, types.NamespacedName{Name: target.Name, Namespace: target.Namespace}, &secret); err != nil {
+			return nil, err
+		}
+	}
+
+	r.clustersMu.Lock()
+	defer r.clustersMu.Unlock()
+	cacheKey := fmt.Sprintf("%s@%s", key, username)
+	if c, ok := r.clusters[cacheKey]; ok {
+		if c.version == secret.ResourceVersion {
+			return c, nil
+		}
+		close(c.stop)
+		delete(r.clusters, cacheKey)
+	}
+
+	c := &cluster{
+		Key:     key,
+		mapper:  r.restMapper,
+		watch:   r.watcher,
+		version: secret.ResourceVersion,
+		stop:    make(chan struct{}),
+	}
+	cfg := r.config
+	if target != nil {
+		dataKey := target.Key
+		if dataKey == "" {
+			dataKey = defaultKubeconfigKey
+		}
+		kubeconfig, ok := secret.Data[dataKey]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrNoKubeconfig, key)
+		}
+		if cfg, err = clientcmd.RESTConfigFromKubeConfig(kubeconfig); err != nil {
+			return nil, err
+		}
+		if c.mapper, err = apiutil.NewDynamicRESTMapper(cfg); err != nil {
+			return nil, err
+		}
+		informers, err := cache.New(cfg, cache.Options{Scheme: r.Scheme, Mapper: c.mapper})
+		if err != nil {
+			return nil, err
+		}
+		c.watch = remoteWatcher(r.controller, informers)
+		go func() {
+			if err := informers.Start(c.stop); err != nil {
+				log.Error(err, "unable to watch target", "target", key)
+			}
+		}()
+	}
+	if username != "" {
+		cfg = rest.CopyConfig(cfg)
+		cfg.Impersonate = rest.ImpersonationConfig{UserName: username}
+	}
+	if c.Client, err = client.New(cfg, client.Options{Scheme: r.Scheme, Mapper: c.mapper}); err != nil {
+		close(c.stop)
+		return nil, err
+	}
+	if r.clusters == nil {
+		r.clusters = make(map[string]*cluster)
+	}
+	r.clusters[cacheKey] = c
+	return c, nil
+}
+
+// clusterForKey returns the cluster of a target key kept in the Hash status.
+func (r *HashReconciler) clusterForKey(ctx context.Context, log logr.Logger, hash *gitv1.Hash, key string) (*cluster, error) {
+	target, err := keyTarget(key)
+	if err != nil {
+		return nil, err
+	}
+	return r.clusterFor(ctx, log, hash, target)
+}
+
+// serviceAccountUsername returns the user a namespace/name ServiceAccount
+// authenticates as, empty when no ServiceAccount is set.
+func serviceAccountUsername(serviceAccount string) (string, error) {
+	if serviceAccount == "" {
+		return "", nil
+	}
+	parts := strings.Split(serviceAccount, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("%w: %s", ErrInvalidServiceAccount, serviceAccount)
+	}
+	return fmt.Sprintf("system:serviceaccount:%s:%s", parts[0], parts[1]), nil
+}
+
+// remoteWatcher watches objects in a remote cluster, events are mapped back
+// to the Hash named in their label. Each kind is only watched once.
+func remoteWatcher(cntrl controller.Controller, informers cache.Informers) func(*unstruct.Unstructured, *gitv1.Hash) error {
+	var mu sync.Mutex
+	watched := make(map[schema.GroupVersionKind]bool)
+	return func(u *unstruct.Unstructured, h *gitv1.Hash) error {
+		mu.Lock()
+		defer mu.Unlock()
+		gvk := u.GroupVersionKind()
+		if watched[gvk] {
+			return nil
+		}
+		obj := &unstruct.Unstructured{}
+		obj.SetGroupVersionKind(gvk)
+		informer, err := informers.GetInformer(obj)
+		if err != nil {
+			return err
+		}
+		if err := cntrl.Watch(&source.Informer{Informer: informer},
+			&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(hashForLabel)},
+			WatchedObjPredicate{},
+		); err != nil {
+			return err
+		}
+		watched[gvk] = true
+		return nil
+	}
+}
+
+// hashForLabel maps an object in a remote cluster to the Hash in its label.
+func hashForLabel(o handler.MapObject) []reconcile.Request {
+	name, ok := o.Meta.GetLabels()[HashLabel]
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: name}}}
+}
+
+// objectReferences returns the objects of a Hash in the cluster of a target key.
+func objectReferences(hash *gitv1.Hash, key string) []corev1.ObjectReference {
+	if key == "" {
+		return hash.Status.Objects
+	}
+	for _, t := range hash.Status.Targets {
+		if t.Target == key {
+			return t.Objects
+		}
+	}
+	return nil
+}
+
+// setObjectReferences replaces the objects of a Hash in the cluster of a target key.
+func setObjectReferences(hash *gitv1.Hash, key string, refs []corev1.ObjectReference) {
+	if key == "" {
+		hash.Status.Objects = refs
+		return
+	}
+	for i, t := range hash.Status.Targets {
+		if t.Target == key {
+			hash.Status.Targets[i].Objects = refs
+			return
+		}
+	}
+	hash.Status.Targets = append(hash.Status.Targets, gitv1.TargetStatus{Target: key, Objects: refs})
+}
+
+// addObjectReference adds an object of a Hash in the cluster of a target key.
+func addObjectReference(hash *gitv1.Hash, key string, ref corev1.ObjectReference) {
+	setObjectReferences(hash, key, append(objectReferences(hash, key), ref))
+}
+
+// targetKeys returns the key of every cluster a Hash has objects in, in status order.
+func targetKeys(hash *gitv1.Hash) []string {
+	keys := []string{""}
+	for _, t := range hash.Status.Targets {
+		keys = append(keys, t.Target)
+	}
+	return keys
+}
+
+// clusterObjects returns the objects of a Hash by target key.
+func clusterObjects(hash *gitv1.Hash) map[string][]corev1.ObjectReference {
+	objs := map[string][]corev1.ObjectReference{"": hash.Status.Objects}
+	for _, t := range hash.Status.Targets {
+		objs[t.Target] = t.Objects
+	}
+	return objs
+}
+
+// deleteTargets removes the objects of a deleted Hash from remote clusters.
+// Targets whose Secret is gone cannot be reached and are skipped.
+func (r *HashReconciler) deleteTargets(ctx context.Context, log logr.Logger, hash *gitv1.Hash) error {
+	for _, t := range hash.Status.Targets {
+		c, err := r.clusterForKey(ctx, log, hash, t.Target)
+		if apierrors.IsNotFound(err) {
+			r.recorder.Event(
+				hash,
+				"Warning",
+				"TargetMissing",
+				fmt.Sprintf("Unable to remove objects from Target:%s %s", t.Target, err),
+			)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, obj := range t.Objects {
+			u := &unstruct.Unstructured{}
+			u.SetName(obj.Name)
+			u.SetNamespace(obj.Namespace)
+			u.SetGroupVersionKind(obj.GroupVersionKind())
+			if err := c.Delete(ctx, u); err != nil && !apierrors.IsNotFound(err) {
+				return err
+			}
+			log.Info("Operation result", "delete", "Object for Hash", "object", u, "target", t.Target)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"errors"
+	"testing"
+
+	v1 "github.com/slipway-gitops/slipway/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+)
+
+func TestTargetKey(t *testing.T) {
+	tests := []struct {
+		target *v1.Target
+		key    string
+	}{
+		{nil, ""},
+		{&v1.Target{Name: "prod", Namespace: "clusters"}, "clusters/prod"},
+		{&v1.Target{Name: "prod", Namespace: "clusters", Key: "kubeconfig"}, "clusters/prod"},
+		{&v1.Target{Name: "prod", Namespace: "clusters", Key: "value"}, "clusters/prod:value"},
+	}
+	for _, tt := range tests {
+		key := targetKey(tt.target)
+		if key != tt.key {
+			t.Errorf("Expected key %q got %q", tt.key, key)
+		}
+		target, err := keyTarget(key)
+		if err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+		if targetKey(target) != key {
+			t.Errorf("Expected %q to round trip got %v", key, target)
+		}
+	}
+	if _, err := keyTarget("prod"); !errors.Is(err, ErrInvalidTarget) {
+		t.Errorf("Expected ErrInvalidTarget got %v", err)
+	}
+}
+
+func TestObjectReferences(t *testing.T) {
+	hash := &v1.Hash{}
+	local := corev1.ObjectReference{Kind: "ConfigMap", Name: "local"}
+	remote := corev1.ObjectReference{Kind: "ConfigMap", Name: "remote"}
+	addObjectReference(hash, "", local)
+	addObjectReference(hash, "clusters/prod", remote)
+	if len(hash.Status.Objects) != 1 || hash.Status.Objects[0] != local {
+		t.Errorf("Expected the local object in Objects got %v", hash.Status.Objects)
+	}
+	if len(hash.Status.Targets) != 1 || objectReferences(hash, "clusters/prod")[0] != remote {
+		t.Errorf("Expected the remote object in Targets got %v", hash.Status.Targets)
+	}
+
+	old := clusterObjects(hash)
+	hash.Status.Objects = nil
+	hash.Status.Targets = nil
+	mergeClusterObjects(hash, old)
+	if len(objectReferences(hash, "")) != 1 || len(objectReferences(hash, "clusters/prod")) != 1 {
+		t.Errorf("Expected merged objects got %v", hash.Status)
+	}
+}
+
+func TestRemoteOwnership(t *testing.T) {
+	hash := &v1.Hash{}
+	hash.Name = "08c913b"
+	c := &cluster{Key: "clusters/prod"}
+	u := newObject("v1", "ConfigMap", nil)
+	if err := c.own(hash, u, nil); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !c.owns(hash, u) || len(u.GetOwnerReferences()) != 0 {
+		t.Errorf("Expected a label and no owner reference got %v", u)
+	}
+	if reqs := hashForLabel(handler.MapObject{Meta: u, Object: u}); len(reqs) != 1 || reqs[0].Name != hash.Name {
+		t.Errorf("Expected a request for the Hash got %v", reqs)
+	}
+}
+
+func TestServiceAccountUsername(t *testing.T) {
+	username, err := serviceAccountUsername("apps/deployer")
+	if err != nil || username != "system:serviceaccount:apps:deployer" {
+		t.Errorf("Unexpected username %q error %v", username, err)
+	}
+	if username, err := serviceAccountUsername(""); err != nil || username != "" {
+		t.Errorf("Expected no username got %q error %v", username, err)
+	}
+	if _, err := serviceAccountUsername("deployer"); !errors.Is(err, ErrInvalidServiceAccount) {
+		t.Errorf("Expected ErrInvalidServiceAccount got %v", err)
+	}
+}
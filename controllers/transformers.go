@@ -0,0 +1,481 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	apiresource "k8s.io/apimachinery/pkg/api/resource"
+	unstruct "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/kustomize/api/builtins"
+	"sigs.k8s.io/kustomize/api/konfig/builtinpluginconsts"
+	"sigs.k8s.io/kustomize/api/resid"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/resource"
+	ktypes "sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/yaml"
+
+	gitv1 "github.com/slipway-gitops/slipway/api/v1"
+	"github.com/slipway-gitops/slipway/pkg/gitfetch"
+	"github.com/slipway-gitops/slipway/pkg/transformer"
+)
+
+// Name of the gitmetadata ConfigMap when the transformer has no key
+const gitMetadataName = "git-metadata"
+
+var (
+	ErrDuplicateTransformer    = errors.New("Transformer plugin has the name of a built-in transformer")
+	ErrInvalidTransformerValue = errors.New("Invalid transformer value")
+	ErrWorkloadNotFound        = errors.New("No workload found")
+	ErrNoGitRepoUri            = errors.New("No GitRepo uri set on Hash")
+)
+
+// Paths to the pod template of the workload kinds
+var podTemplatePaths = map[string][]string{
+	"Deployment.apps":       {"spec", "template"},
+	"StatefulSet.apps":      {"spec", "template"},
+	"DaemonSet.apps":        {"spec", "template"},
+	"ReplicaSet.apps":       {"spec", "template"},
+	"Deployment.extensions": {"spec", "template"},
+	"DaemonSet.extensions":  {"spec", "template"},
+	"ReplicaSet.extensions": {"spec", "template"},
+	"ReplicationController": {"spec", "template"},
+	"Job.batch":             {"spec", "template"},
+	"CronJob.batch":         {"spec", "jobTemplate", "spec", "template"},
+}
+
+// transformFunc changes the resources of an operation.
+type transformFunc func(m resmap.ResMap) error
+
+// configureFunc configures a built-in transformer for a reference.
+type configureFunc func(ctx context.Context, t gitv1.Transformer, ref transformer.Reference) (transformFunc, error)
+
+// builtinTransformer is a transformer shipped with slipway.
+type builtinTransformer struct {
+	configure configureFunc
+	transform transformFunc
+}
+
+// New configures the transformer for a reference.
+func (b builtinTransformer) New(ctx context.Context, t gitv1.Transformer, ref transformer.Reference) (transformer.Transformer, error) {
+	transform, err := b.configure(ctx, t, ref)
+	if err != nil {
+		return nil, err
+	}
+	b.transform = transform
+	return b, nil
+}
+
+// Transform changes the resources.
+func (b builtinTransformer) Transform(m resmap.ResMap) error {
+	return b.transform(m)
+}
+
+// loadTransformers combines the built-in transformers with the plugins,
+// plugins cannot replace built-in transformers.
+func (r *HashReconciler) loadTransformers(plugins map[string]transformer.Transformer) (map[string]transformer.Transformer, error) {
+	transformers := map[string]transformer.Transformer{
+		"annotations": builtinTransformer{configure: annotationsTransformer},
+		"images":      builtinTransformer{configure: imagesTransformer},
+		"labels":      builtinTransformer{configure: labelsTransformer},
+		"namespace":   builtinTransformer{configure: namespaceTransformer},
+		"prefix":      builtinTransformer{configure: prefixTransformer},
+		"suffix":      builtinTransformer{configure: suffixTransformer},
+		"replicas":    builtinTransformer{configure: replicasTransformer},
+		"resources":   builtinTransformer{configure: resourcesTransformer},
+		"patch":       builtinTransformer{configure: patchTransformer},
+		"gitmetadata": builtinTransformer{configure: r.gitMetadataTransformer},
+	}
+	for name, plugin := range plugins {
+		if _, ok := transformers[name]; ok {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateTransformer, name)
+		}
+		transformers[name] = plugin
+	}
+	return transformers, nil
+}
+
+func annotationsTransformer(_ context.Context, t gitv1.Transformer, ref transformer.Reference) (transformFunc, error) {
+	plugin := *annotationsPlugin
+	plugin.Annotations = map[string]string{t.Key: ref.Value}
+	return plugin.Transform, nil
+}
+
+func imagesTransformer(_ context.Context, t gitv1.Transformer, ref transformer.Reference) (transformFunc, error) {
+	plugin := *imagesPlugin
+	var err error
+	if plugin.ImageTag, err = imageTag(ref.Hash, ref.Operation, t, ref.Value); err != nil {
+		return nil, err
+	}
+	return plugin.Transform, nil
+}
+
+func labelsTransformer(_ context.Context, t gitv1.Transformer, ref transformer.Reference) (transformFunc, error) {
+	plugin := *labelsPlugin
+	plugin.Labels = map[string]string{t.Key: ref.Value}
+	return plugin.Transform, nil
+}
+
+func namespaceTransformer(_ context.Context, t gitv1.Transformer, ref transformer.Reference) (transformFunc, error) {
+	plugin := *namespacePlugin
+	plugin.ObjectMeta.Namespace = ref.Value
+	return plugin.Transform, nil
+}
+
+func prefixTransformer(_ context.Context, t gitv1.Transformer, ref transformer.Reference) (transformFunc, error) {
+	return func(m resmap.ResMap) error {
+		return prefixSuffix(m, fmt.Sprintf("%s-", ref.Value), "")
+	}, nil
+}
+
+func suffixTransformer(_ context.Context, t gitv1.Transformer, ref transformer.Reference) (transformFunc, error) {
+	return func(m resmap.ResMap) error {
+		return prefixSuffix(m, "", fmt.Sprintf("-%s", ref.Value))
+	}, nil
+}
+
+func replicasTransformer(_ context.Context, t gitv1.Transformer, ref transformer.Reference) (transformFunc, error) {
+	plugin := *replicasPlugin
+	plugin.Replica.Name = t.Key
+	count, err := strconv.ParseInt(ref.Value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: replicas %s", ErrInvalidTransformerValue, ref.Value)
+	}
+	plugin.Replica.Count = count
+	return plugin.Transform, nil
+}
+
+func resourcesTransformer(_ context.Context, t gitv1.Transformer, ref transformer.Reference) (transformFunc, error) {
+	return func(m resmap.ResMap) error {
+		return setResources(m, t.Key, ref.Value)
+	}, nil
+}
+
+func patchTransformer(_ context.Context, t gitv1.Transformer, ref transformer.Reference) (transformFunc, error) {
+	return func(m resmap.ResMap) error {
+		return patchResources(m, ref.Hash, ref.Operation, t)
+	}, nil
+}
+
+func (r *HashReconciler) gitMetadataTransformer(ctx context.Context, t gitv1.Transformer, ref transformer.Reference) (transformFunc, error) {
+	return func(m resmap.ResMap) error {
+		return r.gitMetadata(ctx, ref.Hash, ref.Operation, t, m)
+	}, nil
+}
+
+// imageTag is the image change of an images transformer. Keys with * are
+// globs, * alone selects every image. Values starting with sha256: pin the
+// digest, other values set the tag.
+func imageTag(hash *gitv1.Hash, operation gitv1.Operation, t gitv1.Transformer, val string) (ktypes.Image, error) {
+	image := ktypes.Image{Name: t.Key}
+	if strings.Contains(t.Key, "*") {
+		image.Name = strings.ReplaceAll(regexp.QuoteMeta(t.Key), `\*`, ".*")
+	}
+	if _, err := regexp.Compile(image.Name); err != nil {
+		return image, fmt.Errorf("%w: images %s: %v", ErrInvalidTransformerValue, t.Key, err)
+	}
+	if strings.HasPrefix(val, "sha256:") {
+		image.Digest = val
+	} else {
+		image.NewTag = val
+	}
+	if t.NewName == "" {
+		return image, nil
+	}
+	newName, err := transformerValue(hash, operation, t.NewName)
+	if err != nil {
+		return image, err
+	}
+	image.NewName = newName
+	return image, nil
+}
+
+// setResources sets the resources of the containers of a workload. The key is
+// the workload name optionally followed by /container, the value is a comma
+// separated list of resource=quantity setting requests, limits.resource=quantity
+// sets limits.
+func setResources(m resmap.ResMap, key, value string) error {
+	requests, limits, err := parseResources(value)
+	if err != nil {
+		return err
+	}
+	name, container := key, ""
+	if i := strings.Index(key, "/"); i >= 0 {
+		name, container = key[:i], key[i+1:]
+	}
+	found := false
+	for _, res := range m.Resources() {
+		if res.CurId().Name != name && res.OrgId().Name != name {
+			continue
+		}
+		for _, c := range workloadContainers(res) {
+			if container != "" && c["name"] != container {
+				continue
+			}
+			found = true
+			for field, values := range map[string]map[string]interface{}{"requests": requests, "limits": limits} {
+				for resourceName, quantity := range values {
+					if err := unstruct.SetNestedField(c, quantity, "resources", field, resourceName); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: resources %s", ErrWorkloadNotFound, key)
+	}
+	return nil
+}
+
+// parseResources parses resource=quantity pairs into requests and limits.
+func parseResources(value string) (requests, limits map[string]interface{}, err error) {
+	requests = make(map[string]interface{})
+	limits = make(map[string]interface{})
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, nil, fmt.Errorf("%w: resources %s", ErrInvalidTransformerValue, value)
+		}
+		quantity, err := apiresource.ParseQuantity(parts[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: resources %s: %v", ErrInvalidTransformerValue, pair, err)
+		}
+		switch {
+		case strings.HasPrefix(parts[0], "limits."):
+			limits[strings.TrimPrefix(parts[0], "limits.")] = quantity.String()
+		default:
+			requests[strings.TrimPrefix(parts[0], "requests.")] = quantity.String()
+		}
+	}
+	return requests, limits, nil
+}
+
+// patchResources applies the templated patch of a transformer to the objects
+// selected by its target.
+func patchResources(m resmap.ResMap, hash *gitv1.Hash, operation gitv1.Operation, t gitv1.Transformer) error {
+	if strings.TrimSpace(t.Patch) == "" {
+		return fmt.Errorf("%w: empty patch", ErrInvalidTransformerValue)
+	}
+	patch, err := transformerValue(hash, operation, t.Patch)
+	if err != nil {
+		return err
+	}
+	plugin := builtins.PatchTransformerPlugin{Patch: patch}
+	if t.Target != nil {
+		plugin.Target = &ktypes.Selector{
+			Gvk: resid.Gvk{
+				Group:   t.Target.Group,
+				Version: t.Target.Version,
+				Kind:    t.Target.Kind,
+			},
+			Name:               t.Target.Name,
+			Namespace:          t.Target.Namespace,
+			LabelSelector:      t.Target.LabelSelector,
+			AnnotationSelector: t.Target.AnnotationSelector,
+		}
+	}
+	config, err := yaml.Marshal(plugin)
+	if err != nil {
+		return err
+	}
+	if err := plugin.Config(resmap.NewPluginHelpers(nil, nil, resmapFactory), config); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTransformerValue, err)
+	}
+	return plugin.Transform(m)
+}
+
+// nameBackReference lists the fields of other objects that refer to a kind by name.
+type nameBackReference struct {
+	resid.Gvk  `json:",inline"`
+	FieldSpecs []ktypes.FieldSpec `json:"fieldSpecs"`
+}
+
+// The name references kustomize updates for namePrefix and nameSuffix
+var nameReferences = func() []nameBackReference {
+	var config struct {
+		NameReference []nameBackReference `json:"nameReference"`
+	}
+	spec := builtinpluginconsts.GetDefaultFieldSpecsAsMap()["namereference"]
+	if err := yaml.Unmarshal([]byte(spec), &config); err != nil {
+		panic(err)
+	}
+	return config.NameReference
+}()
+
+// prefixSuffix adds a prefix and suffix to the names of the objects and
+// updates the references to the renamed objects, like kustomize namePrefix.
+func prefixSuffix(m resmap.ResMap, prefix, suffix string) error {
+	names := make(map[*resource.Resource]string)
+	for _, res := range m.Resources() {
+		names[res] = res.GetName()
+	}
+	plugin := *prefixSuffixPlugin
+	plugin.Prefix = prefix
+	plugin.Suffix = suffix
+	if err := plugin.Transform(m); err != nil {
+		return err
+	}
+	for _, ref := range nameReferences {
+		renamed := make(map[string]string)
+		for res, name := range names {
+			if res.GetGvk().IsSelected(&ref.Gvk) && res.GetName() != name {
+				renamed[name] = res.GetName()
+			}
+		}
+		if len(renamed) == 0 {
+			continue
+		}
+		for _, res := range m.Resources() {
+			for _, fs := range ref.FieldSpecs {
+				if res.GetGvk().IsSelected(&fs.Gvk) {
+					renameReferences(res.Map(), fs.PathSlice(), ref.Kind, renamed)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// renameReferences renames the references to kind at path in obj. Fields
+// next to a kind field, like roleRef and subjects, only refer to that kind.
+func renameReferences(obj interface{}, path []string, kind string, renamed map[string]string) {
+	switch val := obj.(type) {
+	case []interface{}:
+		for _, item := range val {
+			renameReferences(item, path, kind, renamed)
+		}
+	case map[string]interface{}:
+		if len(path) > 1 {
+			renameReferences(val[path[0]], path[1:], kind, renamed)
+			return
+		}
+		switch field := val[path[0]].(type) {
+		case string:
+			if k, ok := val["kind"]; ok && k != kind {
+				return
+			}
+			if name, ok := renamed[field]; ok {
+				val[path[0]] = name
+			}
+		case map[string]interface{}:
+			renameReferences(field, []string{"name"}, kind, renamed)
+		case []interface{}:
+			for i, item := range field {
+				if name, ok := renamed[fmt.Sprint(item)]; ok {
+					field[i] = name
+					continue
+				}
+				renameReferences(item, []string{"name"}, kind, renamed)
+			}
+		}
+	}
+}
+
+// gitMetadata adds a ConfigMap with the metadata of the commit of the Hash,
+// optionally added to the environment of the containers of every workload.
+func (r *HashReconciler) gitMetadata(
+	ctx context.Context,
+	hash *gitv1.Hash,
+	operation gitv1.Operation,
+	t gitv1.Transformer,
+	m resmap.ResMap,
+) error {
+	if hash.Spec.Uri == "" || r.workspace == nil {
+		return fmt.Errorf("%w: %s", ErrNoGitRepoUri, hash.Name)
+	}
+	auth, err := gitAuth(ctx, r.Client, hash.Spec.SecretName, hash.Spec.Uri)
+	if err != nil {
+		return err
+	}
+	commit, err := r.workspace.Commit(ctx, hash.Spec.Uri, hash.Name, hash.Spec.SecretName, auth)
+	if err != nil {
+		return err
+	}
+	name := t.Key
+	if name == "" {
+		name = gitMetadataName
+	}
+	configMap := resmapFactory.RF().FromMap(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name": name,
+		},
+		"data": gitMetadataData(hash, operation, commit),
+	})
+	if err := m.Append(configMap); err != nil {
+		return err
+	}
+	if t.Env {
+		addEnvFrom(m, name)
+	}
+	return nil
+}
+
+// gitMetadataData is the data of the gitmetadata ConfigMap, its keys are
+// valid environment variable names.
+func gitMetadataData(hash *gitv1.Hash, operation gitv1.Operation, commit *gitfetch.CommitInfo) map[string]interface{} {
+	subject := strings.SplitN(strings.TrimSpace(commit.Message), "\n", 2)[0]
+	return map[string]interface{}{
+		"GIT_COMMIT":       commit.SHA,
+		"GIT_SHORT_COMMIT": truncate(shortSHALength, commit.SHA),
+		"GIT_AUTHOR":       fmt.Sprintf("%s <%s>", commit.Author, commit.Email),
+		"GIT_COMMIT_TIME":  commit.Time.UTC().Format(time.RFC3339),
+		"GIT_SUBJECT":      strings.TrimSpace(subject),
+		"GIT_REF":          operation.ReferenceTitle,
+		"GIT_REPO":         hash.Spec.Uri,
+	}
+}
+
+// addEnvFrom adds a ConfigMap to the envFrom of the containers of every workload.
+func addEnvFrom(m resmap.ResMap, name string) {
+	for _, res := range m.Resources() {
+		for _, c := range workloadContainers(res) {
+			envFrom, _ := c["envFrom"].([]interface{})
+			c["envFrom"] = append(envFrom, map[string]interface{}{
+				"configMapRef": map[string]interface{}{"name": name},
+			})
+		}
+	}
+}
+
+// workloadContainers returns the containers of the pod template of a
+// workload, changes to them change the resource.
+func workloadContainers(res *resource.Resource) []map[string]interface{} {
+	gvk := res.GetGvk()
+	path, ok := podTemplatePaths[schema.GroupKind{Group: gvk.Group, Kind: gvk.Kind}.String()]
+	if !ok {
+		return nil
+	}
+	path = append(append([]string{}, path...), "spec", "containers")
+	containers, _, _ := unstruct.NestedFieldNoCopy(res.Map(), path...)
+	list, _ := containers.([]interface{})
+	var result []map[string]interface{}
+	for _, item := range list {
+		if c, ok := item.(map[string]interface{}); ok {
+			result = append(result, c)
+		}
+	}
+	return result
+}
@@ -0,0 +1,675 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/slipway-gitops/slipway/api/v1"
+	"github.com/slipway-gitops/slipway/pkg/gitfetch"
+	"github.com/slipway-gitops/slipway/pkg/transformer"
+	gitclient "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	unstruct "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/kustomize/api/resmap"
+)
+
+const workloads = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 3
+  template:
+    spec:
+      containers:
+      - name: app
+        image: app
+        resources:
+          requests:
+            cpu: "1"
+          limits:
+            memory: 1Gi
+      - name: proxy
+        image: proxy
+---
+apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: report
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+          - name: report
+            image: report
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: web
+  labels:
+    tier: frontend
+---
+apiVersion: networking.k8s.io/v1beta1
+kind: Ingress
+metadata:
+  name: web
+spec:
+  rules:
+  - host: example.com
+`
+
+func workloadResMap(t *testing.T) resmap.ResMap {
+	m, err := resmapFactory.NewResMapFromBytes([]byte(workloads))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestReplicasTransformer(t *testing.T) {
+	m := workloadResMap(t)
+	plugin := *replicasPlugin
+	plugin.Replica.Name = "web"
+	plugin.Replica.Count = 1
+	if err := plugin.Transform(m); err != nil {
+		t.Fatal(err)
+	}
+	out, err := m.AsYaml()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "replicas: 1") || strings.Contains(string(out), "replicas: 3") {
+		t.Errorf("Expected one replica got %s", out)
+	}
+
+	plugin.Replica.Name = "missing"
+	if err := plugin.Transform(m); err == nil {
+		t.Error("Expected an error for a missing workload")
+	}
+}
+
+func TestSetResources(t *testing.T) {
+	tests := []struct {
+		name     string
+		key      string
+		value    string
+		expected []string
+		absent   []string
+		err      error
+	}{
+		{
+			name:     "all containers",
+			key:      "web",
+			value:    "cpu=50m,memory=64Mi",
+			expected: []string{"cpu: 50m", "memory: 64Mi", "memory: 1Gi"},
+			absent:   []string{`cpu: "1"`},
+		},
+		{
+			name:     "one container",
+			key:      "web/proxy",
+			value:    "cpu=10m,limits.memory=32Mi",
+			expected: []string{`cpu: "1"`, "cpu: 10m", "memory: 32Mi", "memory: 1Gi"},
+		},
+		{
+			name:     "cronjob",
+			key:      "report",
+			value:    "requests.memory=128Mi",
+			expected: []string{"memory: 128Mi"},
+		},
+		{name: "missing workload", key: "api", value: "cpu=1", err: ErrWorkloadNotFound},
+		{name: "missing container", key: "web/sidecar", value: "cpu=1", err: ErrWorkloadNotFound},
+		{name: "invalid quantity", key: "web", value: "cpu=lots", err: ErrInvalidTransformerValue},
+		{name: "invalid pair", key: "web", value: "cpu", err: ErrInvalidTransformerValue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := workloadResMap(t)
+			err := setResources(m, tt.key, tt.value)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Expected error %v got %v", tt.err, err)
+			}
+			if err != nil {
+				return
+			}
+			out, err := m.AsYaml()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tt.expected {
+				if !strings.Contains(string(out), s) {
+					t.Errorf("Expected %q in %s", s, out)
+				}
+			}
+			for _, s := range tt.absent {
+				if strings.Contains(string(out), s) {
+					t.Errorf("Expected no %q in %s", s, out)
+				}
+			}
+		})
+	}
+}
+
+func TestPatchResources(t *testing.T) {
+	hash := &v1.Hash{}
+	hash.Name = "abc1234def5678"
+	operation := v1.Operation{Name: "preview", Type: "pull", ReferenceTitle: "pull-42"}
+
+	tests := []struct {
+		name        string
+		transformer v1.Transformer
+		expected    []string
+		err         bool
+	}{
+		{
+			name: "json6902 ingress host",
+			transformer: v1.Transformer{
+				Patch:  "- op: replace\n  path: /spec/rules/0/host\n  value: pr-{{ .PR }}.preview.example.com\n",
+				Target: &v1.PatchTarget{Kind: "Ingress", Name: "web"},
+			},
+			expected: []string{"host: pr-42.preview.example.com"},
+		},
+		{
+			name: "strategic merge by target",
+			transformer: v1.Transformer{
+				Patch:  "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: any\ndata:\n  commit: \"{{ .ShortSHA }}\"\n",
+				Target: &v1.PatchTarget{LabelSelector: "tier=frontend"},
+			},
+			expected: []string{"commit: abc1234"},
+		},
+		{
+			name: "strategic merge by name",
+			transformer: v1.Transformer{
+				Patch: "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\nspec:\n  minReadySeconds: 5\n",
+			},
+			expected: []string{"minReadySeconds: 5"},
+		},
+		{name: "empty", transformer: v1.Transformer{}, err: true},
+		{name: "invalid", transformer: v1.Transformer{Patch: "not a patch"}, err: true},
+		{name: "invalid template", transformer: v1.Transformer{Patch: "{{ .Branch }}"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := workloadResMap(t)
+			tt.transformer.Type = "patch"
+			err := patchResources(m, hash, operation, tt.transformer)
+			if (err != nil) != tt.err {
+				t.Fatalf("Expected error %v got %v", tt.err, err)
+			}
+			if err != nil {
+				return
+			}
+			out, err := m.AsYaml()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tt.expected {
+				if !strings.Contains(string(out), s) {
+					t.Errorf("Expected %q in %s", s, out)
+				}
+			}
+		})
+	}
+}
+
+const references = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: app
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: reader
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: app-reader
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: reader
+subjects:
+- kind: ServiceAccount
+  name: app
+- kind: User
+  name: app
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: app-view
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: reader
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      serviceAccountName: app
+      containers:
+      - name: app
+        envFrom:
+        - configMapRef:
+            name: config
+        - configMapRef:
+            name: external
+      volumes:
+      - name: config
+        configMap:
+          name: config
+---
+apiVersion: networking.k8s.io/v1beta1
+kind: Ingress
+metadata:
+  name: web
+spec:
+  backend:
+    serviceName: web
+    servicePort: 80
+`
+
+func TestPrefixSuffixReferences(t *testing.T) {
+	m, err := resmapFactory.NewResMapFromBytes([]byte(references))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := prefixSuffix(m, "pr-42-", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := prefixSuffix(m, "", "-blue"); err != nil {
+		t.Fatal(err)
+	}
+
+	field := func(kind, name string, path ...string) interface{} {
+		for _, res := range m.Resources() {
+			if res.GetKind() == kind && res.GetName() == name {
+				val, _, _ := unstruct.NestedFieldNoCopy(res.Map(), path...)
+				return val
+			}
+		}
+		t.Fatalf("Expected a %s named %s", kind, name)
+		return nil
+	}
+	template := func(path ...string) interface{} {
+		return field("Deployment", "pr-42-web-blue", append([]string{"spec", "template", "spec"}, path...)...)
+	}
+
+	if name := template("serviceAccountName"); name != "pr-42-app-blue" {
+		t.Errorf("Expected the renamed ServiceAccount got %v", name)
+	}
+	volumes := template("volumes").([]interface{})
+	if name := volumes[0].(map[string]interface{})["configMap"].(map[string]interface{})["name"]; name != "pr-42-config-blue" {
+		t.Errorf("Expected the renamed ConfigMap volume got %v", name)
+	}
+	envFrom := template("containers").([]interface{})[0].(map[string]interface{})["envFrom"].([]interface{})
+	if name := envFrom[0].(map[string]interface{})["configMapRef"].(map[string]interface{})["name"]; name != "pr-42-config-blue" {
+		t.Errorf("Expected the renamed ConfigMap reference got %v", name)
+	}
+	if name := envFrom[1].(map[string]interface{})["configMapRef"].(map[string]interface{})["name"]; name != "external" {
+		t.Errorf("Expected references to other objects to stay got %v", name)
+	}
+	if name := field("RoleBinding", "pr-42-app-reader-blue", "roleRef", "name"); name != "pr-42-reader-blue" {
+		t.Errorf("Expected the renamed Role got %v", name)
+	}
+	if name := field("RoleBinding", "pr-42-app-view-blue", "roleRef", "name"); name != "reader" {
+		t.Errorf("Expected the ClusterRole to stay got %v", name)
+	}
+	subjects := field("RoleBinding", "pr-42-app-reader-blue", "subjects").([]interface{})
+	if name := subjects[0].(map[string]interface{})["name"]; name != "pr-42-app-blue" {
+		t.Errorf("Expected the renamed ServiceAccount subject got %v", name)
+	}
+	if name := subjects[1].(map[string]interface{})["name"]; name != "app" {
+		t.Errorf("Expected the User subject to stay got %v", name)
+	}
+	if name := field("Ingress", "pr-42-web-blue", "spec", "backend", "serviceName"); name != "pr-42-web-blue" {
+		t.Errorf("Expected the renamed Service got %v", name)
+	}
+}
+
+func TestGitMetadata(t *testing.T) {
+	origin, err := ioutil.TempDir("", "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(origin)
+	repo, err := gitclient.PlainInit(origin, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	when := time.Date(2020, 6, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	sha, err := wt.Commit("Add version endpoint\n\nDetails of the change\n", &gitclient.CommitOptions{
+		Author: &object.Signature{Name: "Jane Doe", Email: "jane@example.com", When: when},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	workspace, err := gitfetch.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &HashReconciler{workspace: workspace}
+	hash := &v1.Hash{}
+	hash.Name = sha.String()
+	hash.Spec.Uri = origin
+	operation := v1.Operation{Name: "app", Type: "branch", ReferenceTitle: "master"}
+
+	m := workloadResMap(t)
+	transformer := v1.Transformer{Type: "gitmetadata", Key: "version", Env: true}
+	if err := r.gitMetadata(context.Background(), hash, operation, transformer, m); err != nil {
+		t.Fatal(err)
+	}
+	out, err := m.AsYaml()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"GIT_COMMIT: " + sha.String(),
+		"GIT_SHORT_COMMIT: " + sha.String()[:7],
+		"GIT_AUTHOR: Jane Doe <jane@example.com>",
+		`GIT_COMMIT_TIME: "2020-06-01T10:00:00Z"`,
+		"GIT_SUBJECT: Add version endpoint",
+		"GIT_REF: master",
+		"GIT_REPO: " + origin,
+	}
+	for _, s := range expected {
+		if !strings.Contains(string(out), s) {
+			t.Errorf("Expected %q in %s", s, out)
+		}
+	}
+	for _, res := range m.Resources() {
+		for _, c := range workloadContainers(res) {
+			envFrom, _ := c["envFrom"].([]interface{})
+			if len(envFrom) != 1 {
+				t.Errorf("Expected the ConfigMap in the environment of %s got %v", c["name"], envFrom)
+			}
+		}
+	}
+
+	hash.Spec.Uri = ""
+	if err := r.gitMetadata(context.Background(), hash, operation, transformer, workloadResMap(t)); !errors.Is(err, ErrNoGitRepoUri) {
+		t.Errorf("Expected %v got %v", ErrNoGitRepoUri, err)
+	}
+}
+
+const images = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: migrate
+        image: example/app:1.0
+      containers:
+      - name: app
+        image: example/app:1.0
+      - name: proxy
+        image: envoy:1.14
+---
+apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: report
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+          - name: report
+            image: example/app
+---
+apiVersion: example.com/v1
+kind: Worker
+metadata:
+  name: queue
+spec:
+  pod:
+    containers:
+    - name: worker
+      image: example/app:1.0
+`
+
+func TestImagesTransformer(t *testing.T) {
+	hash := &v1.Hash{}
+	hash.Name = "abc1234def5678"
+	operation := v1.Operation{Name: "preview", Type: "pull", ReferenceTitle: "pull-42"}
+	digest := "sha256:24a0c4b4a4c0eb97a1aabb8e29f18e917d05abfe1b7a7c07857230879ce7d3d3"
+
+	tests := []struct {
+		name        string
+		transformer v1.Transformer
+		value       string
+		expected    []string
+		absent      []string
+	}{
+		{
+			name:        "tag everywhere",
+			transformer: v1.Transformer{Key: "example/app"},
+			value:       "pull-42",
+			expected:    []string{"image: example/app:pull-42", "image: envoy:1.14"},
+			absent:      []string{"example/app:1.0", "image: example/app\n"},
+		},
+		{
+			name:        "digest",
+			transformer: v1.Transformer{Key: "example/app"},
+			value:       digest,
+			expected:    []string{"image: example/app@" + digest},
+			absent:      []string{"example/app:1.0"},
+		},
+		{
+			name:        "new name",
+			transformer: v1.Transformer{Key: "example/app", NewName: "registry.example.com/{{ .Operation }}/app"},
+			value:       "{{ .ShortSHA }}",
+			expected:    []string{"image: registry.example.com/preview/app:abc1234"},
+			absent:      []string{"example/app:1.0"},
+		},
+		{
+			name:        "all images",
+			transformer: v1.Transformer{Key: "*"},
+			value:       "stable",
+			expected:    []string{"image: example/app:stable", "image: envoy:stable"},
+			absent:      []string{":1.0", ":1.14"},
+		},
+		{
+			name:        "glob",
+			transformer: v1.Transformer{Key: "example/*"},
+			value:       "stable",
+			expected:    []string{"image: example/app:stable", "image: envoy:1.14"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := resmapFactory.NewResMapFromBytes([]byte(images))
+			if err != nil {
+				t.Fatal(err)
+			}
+			val, err := transformerValue(hash, operation, tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plugin := *imagesPlugin
+			if plugin.ImageTag, err = imageTag(hash, operation, tt.transformer, val); err != nil {
+				t.Fatal(err)
+			}
+			if err := plugin.Transform(m); err != nil {
+				t.Fatal(err)
+			}
+			out, err := m.AsYaml()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tt.expected {
+				if !strings.Contains(string(out), s) {
+					t.Errorf("Expected %q in %s", s, out)
+				}
+			}
+			for _, s := range tt.absent {
+				if strings.Contains(string(out), s) {
+					t.Errorf("Expected no %q in %s", s, out)
+				}
+			}
+		})
+	}
+
+	if _, err := imageTag(hash, operation, v1.Transformer{Key: "example/(app"}, "1.0"); !errors.Is(err, ErrInvalidTransformerValue) {
+		t.Errorf("Expected %v got %v", ErrInvalidTransformerValue, err)
+	}
+}
+
+// costCenter is a transformer like an organization would add as a plugin.
+type costCenter struct {
+	value string
+}
+
+func (c costCenter) New(_ context.Context, _ v1.Transformer, ref transformer.Reference) (transformer.Transformer, error) {
+	return costCenter{value: ref.Value}, nil
+}
+
+func (c costCenter) Transform(m resmap.ResMap) error {
+	for _, res := range m.Resources() {
+		labels := res.GetLabels()
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels["cost-center"] = c.value
+		res.SetLabels(labels)
+	}
+	return nil
+}
+
+func TestTransformers(t *testing.T) {
+	r := &HashReconciler{}
+	if _, err := r.loadTransformers(map[string]transformer.Transformer{"labels": costCenter{}}); !errors.Is(err, ErrDuplicateTransformer) {
+		t.Errorf("Expected %v got %v", ErrDuplicateTransformer, err)
+	}
+	var err error
+	r.transformers, err = r.loadTransformers(map[string]transformer.Transformer{"costcenter": costCenter{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "transformers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "workloads.yaml"), []byte(workloads), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash := &v1.Hash{}
+	hash.Name = "abc1234def5678"
+	hash.Spec.GitRepo = "example-app"
+	operation := v1.Operation{
+		Name:           "app",
+		Type:           "branch",
+		ReferenceTitle: "feature/login",
+		Path:           dir,
+		Renderer:       v1.RendererRaw,
+		Transformers: []v1.Transformer{
+			{Type: "labels", Key: "repo", Value: "{{ .GitRepo }}"},
+			{Type: "namespace", Value: "branch"},
+			{Type: "prefix", Value: "preview"},
+			{Type: "costcenter", Value: "cc-{{ .ShortSHA }}"},
+		},
+	}
+	log := ctrl.Log.WithName("test")
+	m, namespaces, _, err := r.build(context.Background(), log, hash, nil, operation, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sanitized, _ := sanitizeValue(v1.Transformer{Type: "namespace"}, "feature/login")
+	if len(namespaces) != 1 || namespaces[0] != sanitized {
+		t.Errorf("Expected namespace %s got %v", sanitized, namespaces)
+	}
+	for _, res := range m.Resources() {
+		labels := res.GetLabels()
+		if labels["repo"] != "example-app" || labels["cost-center"] != "cc-abc1234" {
+			t.Errorf("Expected the labels on %s got %v", res.GetName(), labels)
+		}
+		if res.GetNamespace() != sanitized || !strings.HasPrefix(res.GetName(), "preview-") {
+			t.Errorf("Expected %s to be moved and renamed", res.CurId())
+		}
+	}
+
+	// Built-in transformers do not share values between operations
+	operation.Transformers = []v1.Transformer{{Type: "labels", Key: "team", Value: "web"}}
+	if m, _, _, err = r.build(context.Background(), log, hash, nil, operation, ""); err != nil {
+		t.Fatal(err)
+	}
+	if labels := m.Resources()[0].GetLabels(); labels["repo"] != "" {
+		t.Errorf("Expected only the labels of the operation got %v", labels)
+	}
+
+	operation.Transformers = []v1.Transformer{{Type: "sidecar", Value: "enabled"}}
+	if _, _, _, err := r.build(context.Background(), log, hash, nil, operation, ""); !errors.Is(err, transformer.ErrInvalidType) {
+		t.Errorf("Expected %v got %v", transformer.ErrInvalidType, err)
+	}
+}
+
+func TestTransformerPlugins(t *testing.T) {
+	plugin := "../internal/bin/transformers/labels.so"
+	if _, err := os.Stat(plugin); os.IsNotExist(err) {
+		t.Skip("test plugins are not built, run make testplugins")
+	}
+	dir, err := ioutil.TempDir("", "transformers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input, err := ioutil.ReadFile(plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, filepath.Base(plugin)), input, 0664); err != nil {
+		t.Fatal(err)
+	}
+	plugins, err := transformer.LoadTransformers(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, ok := plugins["labels"]; !ok {
+		t.Fatalf("Expected the labels plugin got %v", plugins)
+	}
+	r := &HashReconciler{}
+	if _, err := r.loadTransformers(plugins); !errors.Is(err, ErrDuplicateTransformer) {
+		t.Errorf("Expected the plugin not to shadow the built-in labels transformer got %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/semver/v3"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	gitv1 "github.com/slipway-gitops/slipway/api/v1"
+)
+
+// Length of the ShortSHA of a commit
+const shortSHALength = 7
+
+// refVars are the variables of transformer value templates.
+type refVars struct {
+	// SHA of the commit
+	SHA string
+	// ShortSHA is the first 7 characters of the SHA
+	ShortSHA string
+	// Ref is the reference title such as master, v1.4.2 or pull-42
+	Ref string
+	// OpType is the type of the operation
+	OpType string
+	// PR is the number of the pull request, empty for other types
+	PR string
+	// Semver parts of a tag, empty when the reference is not a version tag
+	Major, Minor, Patch, Prerelease string
+	// Version is the tag without a leading v
+	Version string
+	// GitRepo is the name of the GitRepo
+	GitRepo string
+	// Operation is the name of the operation
+	Operation string
+}
+
+// Functions of transformer value templates
+var valueFuncs = template.FuncMap{
+	"trunc":   truncate,
+	"dns1123": dns1123,
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"replace": func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+}
+
+// newRefVars describes the reference of an operation for templates.
+func newRefVars(hash *gitv1.Hash, operation gitv1.Operation) refVars {
+	vars := refVars{
+		SHA:       hash.Name,
+		ShortSHA:  truncate(shortSHALength, hash.Name),
+		Ref:       operation.ReferenceTitle,
+		OpType:    string(operation.Type),
+		GitRepo:   hash.Spec.GitRepo,
+		Operation: operation.Name,
+	}
+	if operation.Type == "pull" {
+		vars.PR = strings.TrimPrefix(operation.ReferenceTitle, "pull-")
+	}
+	if operation.Type != "tag" && operation.Type != "highesttag" {
+		return vars
+	}
+	if v, err := semver.NewVersion(operation.ReferenceTitle); err == nil {
+		vars.Major = fmt.Sprint(v.Major())
+		vars.Minor = fmt.Sprint(v.Minor())
+		vars.Patch = fmt.Sprint(v.Patch())
+		vars.Prerelease = v.Prerelease()
+		vars.Version = v.String()
+	}
+	return vars
+}
+
+// transformerValue is the value a transformer sets. The reserved values load
+// the reference, values with {{ }} are templates of the reference variables
+// and anything else is used as is.
+func transformerValue(hash *gitv1.Hash, operation gitv1.Operation, value string) (string, error) {
+	switch value {
+	case "branch", "pull", "tag":
+		return operation.ReferenceTitle, nil
+	case "hash":
+		return hash.Name, nil
+	}
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+	t, err := template.New("value").Funcs(valueFuncs).Option("missingkey=error").Parse(value)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, newRefVars(hash, operation)); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// truncate shortens s to at most n characters.
+func truncate(n int, s string) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+var dns1123Invalid = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// dns1123 makes s a valid DNS-1123 label: lower case alphanumerics and '-',
+// starting and ending with an alphanumeric and at most 63 characters.
+func dns1123(s string) string {
+	s = dns1123Invalid.ReplaceAllString(strings.ToLower(s), "-")
+	return strings.Trim(truncate(63, strings.Trim(s, "-")), "-")
+}
+
+// Transformers whose values become part of object names
+var nameTransformers = map[string]bool{
+	"namespace": true,
+	"prefix":    true,
+	"suffix":    true,
+}
+
+// sanitizeValue makes the value of a name transformer a valid DNS-1123 label
+// unless sanitizing is disabled. Values that have to change get a hash of the
+// original appended so different values do not end up the same, changed
+// reports if they did.
+func sanitizeValue(t gitv1.Transformer, value string) (sanitized string, changed bool) {
+	if !nameTransformers[t.Type] || (t.Sanitize != nil && !*t.Sanitize) {
+		return value, false
+	}
+	if value == "" || len(validation.IsDNS1123Label(value)) == 0 {
+		return value, false
+	}
+	suffix := fmt.Sprintf("%x", sha256.Sum256([]byte(value)))[:6]
+	base := strings.Trim(truncate(validation.DNS1123LabelMaxLength-len(suffix)-1, dns1123(value)), "-")
+	if base == "" {
+		return suffix, true
+	}
+	return fmt.Sprintf("%s-%s", base, suffix), true
+}
+
+// sanitizedValues lists the transformer values of an operation that are sanitized.
+func sanitizedValues(hash *gitv1.Hash, operation gitv1.Operation) []gitv1.SanitizedValue {
+	var values []gitv1.SanitizedValue
+	for _, t := range operation.Transformers {
+		val, err := transformerValue(hash, operation, t.Value)
+		if err != nil {
+			continue
+		}
+		if sanitized, changed := sanitizeValue(t, val); changed {
+			values = append(values, gitv1.SanitizedValue{
+				Transformer: t.Type,
+				Value:       val,
+				Sanitized:   sanitized,
+			})
+		}
+	}
+	return values
+}
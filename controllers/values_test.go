@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	v1 "github.com/slipway-gitops/slipway/api/v1"
+)
+
+func TestTransformerValue(t *testing.T) {
+	hash := &v1.Hash{}
+	hash.Name = "abc1234def5678abc1234def5678abc1234def56"
+	hash.Spec.GitRepo = "example-app"
+	pull := v1.Operation{Name: "preview", Type: "pull", ReferenceTitle: "pull-42"}
+	tag := v1.Operation{Name: "release", Type: "tag", ReferenceTitle: "v1.4.2-rc.1"}
+	branch := v1.Operation{Name: "app", Type: "branch", ReferenceTitle: "Feature/Login_Page"}
+
+	tests := []struct {
+		name      string
+		operation v1.Operation
+		value     string
+		expected  string
+		err       bool
+	}{
+		{"reserved branch", branch, "branch", "Feature/Login_Page", false},
+		{"reserved hash", branch, "hash", hash.Name, false},
+		{"literal", branch, "production", "production", false},
+		{"hostname", pull, "pr-{{ .PR }}.preview.example.com", "pr-42.preview.example.com", false},
+		{"image tag", tag, "{{ .Major }}.{{ .Minor }}.{{ .Patch }}-{{ .ShortSHA }}", "1.4.2-abc1234", false},
+		{"version", tag, "{{ .Version }} {{ .Prerelease }}", "1.4.2-rc.1 rc.1", false},
+		{"no semver for branches", v1.Operation{Type: "branch", ReferenceTitle: "1"}, "{{ .Major }}", "", false},
+		{"names", branch, "{{ .GitRepo }}-{{ .Operation }}-{{ .OpType }}", "example-app-app-branch", false},
+		{"dns1123", branch, "{{ .Ref | dns1123 }}", "feature-login-page", false},
+		{"trunc", branch, "{{ .SHA | trunc 10 }}", "abc1234def", false},
+		{"long dns1123", branch, "{{ printf \"%s-%s\" .SHA .SHA | dns1123 }}", "abc1234def5678abc1234def5678abc1234def56-abc1234def5678abc1234d", false},
+		{"unknown variable", branch, "{{ .Branch }}", "", true},
+		{"invalid template", branch, "{{ .Ref ", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			val, err := transformerValue(hash, tt.operation, tt.value)
+			if (err != nil) != tt.err {
+				t.Fatalf("Expected error %v got %v", tt.err, err)
+			}
+			if val != tt.expected {
+				t.Errorf("Expected %q got %q", tt.expected, val)
+			}
+		})
+	}
+}
+
+func TestSanitizeValue(t *testing.T) {
+	disabled := false
+	long := "feature/" + strings.Repeat("a", 70)
+
+	tests := []struct {
+		name        string
+		transformer v1.Transformer
+		value       string
+		expected    string
+		changed     bool
+	}{
+		{"valid", v1.Transformer{Type: "namespace"}, "feature-login", "feature-login", false},
+		{"slash", v1.Transformer{Type: "namespace"}, "feature/Foo_bar", "feature-foo-bar-", true},
+		{"prefix", v1.Transformer{Type: "prefix"}, "Release_1", "release-1-", true},
+		{"long", v1.Transformer{Type: "suffix"}, long, "feature-" + strings.Repeat("a", 48) + "-", true},
+		{"only invalid", v1.Transformer{Type: "namespace"}, "___", "", true},
+		{"disabled", v1.Transformer{Type: "namespace", Sanitize: &disabled}, "feature/Foo", "feature/Foo", false},
+		{"not a name", v1.Transformer{Type: "labels"}, "feature/Foo", "feature/Foo", false},
+		{"empty", v1.Transformer{Type: "namespace"}, "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			val, changed := sanitizeValue(tt.transformer, tt.value)
+			if changed != tt.changed {
+				t.Fatalf("Expected changed %v got %v", tt.changed, changed)
+			}
+			if !strings.HasPrefix(val, tt.expected) {
+				t.Errorf("Expected %q to start with %q", val, tt.expected)
+			}
+			if !changed {
+				return
+			}
+			if errs := validation.IsDNS1123Label(val); len(errs) > 0 {
+				t.Errorf("Expected a DNS-1123 label got %q: %v", val, errs)
+			}
+			if again, _ := sanitizeValue(tt.transformer, tt.value); again != val {
+				t.Errorf("Expected a stable value %q got %q", val, again)
+			}
+		})
+	}
+
+	a, _ := sanitizeValue(v1.Transformer{Type: "namespace"}, "feature/foo")
+	b, _ := sanitizeValue(v1.Transformer{Type: "namespace"}, "feature_foo")
+	if a == b {
+		t.Errorf("Expected different values to not collide, both are %q", a)
+	}
+}
@@ -7,6 +7,7 @@ require (
 	github.com/aws/aws-sdk-go v1.29.32
 	github.com/davecgh/go-spew v1.1.1
 	github.com/go-logr/logr v0.1.0
+	github.com/google/go-jsonnet v0.16.0
 	github.com/lithammer/shortuuid v3.0.0+incompatible
 	github.com/lithammer/shortuuid/v3 v3.0.4 // indirect
 	github.com/onsi/ginkgo v1.11.0
@@ -19,4 +20,5 @@ require (
 	k8s.io/client-go v0.17.3
 	sigs.k8s.io/controller-runtime v0.5.1
 	sigs.k8s.io/kustomize/api v0.3.2
+	sigs.k8s.io/yaml v1.1.0
 )
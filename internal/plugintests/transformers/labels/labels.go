@@ -0,0 +1,41 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+
+	gitv1 "github.com/slipway-gitops/slipway/api/v1"
+	"github.com/slipway-gitops/slipway/pkg/transformer"
+	"sigs.k8s.io/kustomize/api/resmap"
+)
+
+// This is for testing the loader, it has the name of a built-in transformer
+
+var (
+	Transformer fake
+)
+
+type fake struct {
+}
+
+func (f fake) New(ctx context.Context, config gitv1.Transformer, ref transformer.Reference) (transformer.Transformer, error) {
+	return f, nil
+}
+
+func (f fake) Transform(m resmap.ResMap) error {
+	return nil
+}
@@ -45,10 +45,18 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var pluginpath string
+	var renderCacheDir string
+	var workspaceDir string
+	var helmBinary string
+	var sopsBinary string
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. Enabling this will ensure there is only one active controller manager.")
 	flag.StringVar(&pluginpath, "plugin-path", "/etc/slipway/", "The base directory for slipway  plugins")
+	flag.StringVar(&renderCacheDir, "render-cache-dir", "", "The directory to keep rendered manifests in, they are only kept in memory when empty")
+	flag.StringVar(&workspaceDir, "workspace-dir", "", "The directory repositories are mirrored and checked out in, a slipway directory in the temp directory when empty")
+	flag.StringVar(&helmBinary, "helm-binary", "helm", "The helm binary used by the helm renderer")
+	flag.StringVar(&sopsBinary, "sops-binary", "sops", "The sops binary used to decrypt Secrets")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(func(o *zap.Options) {
@@ -77,10 +85,14 @@ func main() {
 		os.Exit(1)
 	}
 	if err = (&controllers.HashReconciler{
-		Client:     mgr.GetClient(),
-		Log:        ctrl.Log.WithName("controllers").WithName("Hash"),
-		Scheme:     mgr.GetScheme(),
-		PluginPath: pluginpath,
+		Client:         mgr.GetClient(),
+		Log:            ctrl.Log.WithName("controllers").WithName("Hash"),
+		Scheme:         mgr.GetScheme(),
+		PluginPath:     pluginpath,
+		RenderCacheDir: renderCacheDir,
+		WorkspaceDir:   workspaceDir,
+		HelmBinary:     helmBinary,
+		SopsBinary:     sopsBinary,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Hash")
 		os.Exit(1)
@@ -0,0 +1,421 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+/*
+GitFetch checks out kustomize remote paths with go-git so they can be built
+from a local directory instead of having kustomize shell out to git.
+Repositories are kept as one bare mirror per url that is fetched incrementally,
+commits are checked out from it once and shared while they are in use.
+*/
+
+package gitfetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	gitclient "gopkg.in/src-d/go-git.v4"
+	gitclientconfig "gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+// The mirror fetches every ref so pull request refs are available too
+var mirrorRefSpec = gitclientconfig.RefSpec("+refs/*:refs/*")
+
+var (
+	// ErrUnknownRef is returned when a ref is not in the repository.
+	ErrUnknownRef = errors.New("Unknown git ref")
+)
+
+// Remote is a kustomize remote path split into its parts.
+type Remote struct {
+	// Repo is the url of the repository
+	Repo string
+	// Dir is the directory within the repository
+	Dir string
+	// Ref is the branch, tag or commit, the default branch when empty
+	Ref string
+}
+
+// Parse splits a kustomize remote path such as
+// git@github.com:org/repo.git//dir?ref=v1 into its parts.
+// Paths that are not remote return false.
+func Parse(path string) (Remote, bool) {
+	var remote Remote
+	if i := strings.Index(path, "?ref="); i >= 0 {
+		path, remote.Ref = path[:i], path[i+len("?ref="):]
+	}
+	start := 0
+	switch {
+	case strings.Contains(path, "://"):
+		start = strings.Index(path, "://") + len("://")
+	case strings.HasPrefix(path, "git@"):
+	case strings.HasPrefix(path, "github.com/"):
+		// github.com/org/repo/dir is a repository on github
+		parts := strings.SplitN(path, "/", 4)
+		if len(parts) < 3 {
+			return Remote{}, false
+		}
+		remote.Repo = "https://" + strings.Join(parts[:3], "/")
+		if len(parts) == 4 {
+			remote.Dir = parts[3]
+		}
+		return remote, true
+	default:
+		return Remote{}, false
+	}
+	remote.Repo = path
+	if i := strings.Index(path[start:], "//"); i >= 0 {
+		remote.Repo, remote.Dir = path[:start+i], path[start+i+len("//"):]
+	} else if i := strings.Index(path, ".git/"); i >= 0 {
+		remote.Repo, remote.Dir = path[:i+len(".git")], path[i+len(".git/"):]
+	} else if i := githubRepo(path, start); i > 0 && i < len(path) {
+		remote.Repo, remote.Dir = path[:i], path[i+1:]
+	}
+	return remote, true
+}
+
+// githubRepo returns the end of the org/repo part of a github.com path
+// starting at start, or 0 when the host is not github.com.
+func githubRepo(path string, start int) int {
+	host := path[start:]
+	// Skip the user of git@github.com:org/repo
+	if i := strings.Index(host, "@"); i >= 0 && !strings.ContainsAny(host[:i], "/:") {
+		start, host = start+i+1, host[i+1:]
+	}
+	if !strings.HasPrefix(host, "github.com/") && !strings.HasPrefix(host, "github.com:") {
+		return 0
+	}
+	parts := strings.SplitN(host[len("github.com/"):], "/", 3)
+	if len(parts) < 2 {
+		return 0
+	}
+	return start + len("github.com/") + len(parts[0]) + len("/") + len(parts[1])
+}
+
+// Workspace keeps the repository mirrors and the checkouts made from them.
+type Workspace struct {
+	dir string
+
+	mu sync.Mutex
+	// locks serialize fetches and checkouts of each repository
+	locks map[string]*sync.Mutex
+	// users of each checkout, it is removed when none are left
+	users map[string]int
+}
+
+// New creates a workspace in dir, checkouts left from a previous run are removed.
+func New(dir string) (*Workspace, error) {
+	if err := os.RemoveAll(filepath.Join(dir, "checkouts")); err != nil {
+		return nil, err
+	}
+	for _, d := range []string{"repos", "checkouts"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Workspace{
+		dir:   dir,
+		locks: make(map[string]*sync.Mutex),
+		users: make(map[string]int),
+	}, nil
+}
+
+// Checkout is a repository checked out at a commit.
+type Checkout struct {
+	// Path of the directory of the remote path
+	Path string
+	// Root of the repository
+	Root string
+	// Commit the repository is checked out at
+	Commit string
+	w      *Workspace
+}
+
+// Close releases the checkout, it is removed once no one else uses it.
+func (c *Checkout) Close() error {
+	c.w.mu.Lock()
+	defer c.w.mu.Unlock()
+	c.w.users[c.Root]--
+	if c.w.users[c.Root] > 0 {
+		return nil
+	}
+	delete(c.w.users, c.Root)
+	return os.RemoveAll(c.Root)
+}
+
+// Checkout provides the repository of a remote at its ref. The mirror of the
+// repository is only fetched when the ref is not a commit it already has.
+// Mirrors are kept per credentials, such as the name of the Secret of the
+// auth, so a commit fetched with one is never served to another.
+// The checkout has to be closed once it is no longer used.
+func (w *Workspace) Checkout(ctx context.Context, remote Remote, credentials string, auth transport.AuthMethod) (*Checkout, error) {
+	key := mirrorKey(remote.Repo, credentials)
+	lock := w.lock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	repo, hash, err := w.update(ctx, remote.Repo, key, remote.Ref, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	// Checkouts of the repository are only extracted while its lock is held,
+	// the user is added at once so a Close in between cannot remove it
+	root := filepath.Join(w.dir, "checkouts", key, hash.String())
+	w.mu.Lock()
+	inUse := w.users[root] > 0
+	w.users[root]++
+	w.mu.Unlock()
+	checkout := &Checkout{
+		Path:   filepath.Join(root, filepath.FromSlash(remote.Dir)),
+		Root:   root,
+		Commit: hash.String(),
+		w:      w,
+	}
+	if !inUse {
+		if err := extract(repo, hash, root); err != nil {
+			checkout.Close()
+			return nil, err
+		}
+	}
+	return checkout, nil
+}
+
+// mirrorKey is the key of the mirror of a repository for the credentials.
+func mirrorKey(url, credentials string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(url+"\x00"+credentials)))
+}
+
+// CommitInfo is the metadata of a commit.
+type CommitInfo struct {
+	SHA     string
+	Author  string
+	Email   string
+	Time    time.Time
+	Message string
+}
+
+// Commit reads the metadata of the commit of a ref, the mirror of the
+// credentials is only fetched when the ref is not a commit it already has.
+func (w *Workspace) Commit(ctx context.Context, url, ref, credentials string, auth transport.AuthMethod) (*CommitInfo, error) {
+	key := mirrorKey(url, credentials)
+	lock := w.lock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	repo, hash, err := w.update(ctx, url, key, ref, auth)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	return &CommitInfo{
+		SHA:     commit.Hash.String(),
+		Author:  commit.Author.Name,
+		Email:   commit.Author.Email,
+		Time:    commit.Author.When,
+		Message: commit.Message,
+	}, nil
+}
+
+// update resolves a ref in the mirror of a repository, fetching it when the
+// ref is not a commit the mirror has. The lock of the repository has to be held.
+func (w *Workspace) update(
+	ctx context.Context,
+	url, key, ref string,
+	auth transport.AuthMethod,
+) (*gitclient.Repository, plumbing.Hash, error) {
+	repo, err := w.mirror(url, key)
+	if err != nil {
+		return nil, plumbing.ZeroHash, err
+	}
+	hash, err := resolve(repo, ref)
+	if err != nil || hash.String() != ref {
+		if err := fetch(ctx, repo, ref, auth); err != nil {
+			return nil, plumbing.ZeroHash, err
+		}
+		if hash, err = resolve(repo, ref); err != nil {
+			return nil, plumbing.ZeroHash, err
+		}
+	}
+	return repo, hash, nil
+}
+
+// lock returns the lock of a repository.
+func (w *Workspace) lock(key string) *sync.Mutex {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.locks[key]; !ok {
+		w.locks[key] = &sync.Mutex{}
+	}
+	return w.locks[key]
+}
+
+// mirror opens the bare mirror of a repository, creating it when missing.
+func (w *Workspace) mirror(url, key string) (*gitclient.Repository, error) {
+	path := filepath.Join(w.dir, "repos", key+".git")
+	repo, err := gitclient.PlainOpen(path)
+	if err != gitclient.ErrRepositoryNotExists {
+		return repo, err
+	}
+	repo, err = gitclient.PlainInit(path, true)
+	if err != nil {
+		return nil, err
+	}
+	_, err = repo.CreateRemote(&gitclientconfig.RemoteConfig{
+		Name:  "origin",
+		URLs:  []string{url},
+		Fetch: []gitclientconfig.RefSpec{mirrorRefSpec},
+	})
+	if err != nil {
+		os.RemoveAll(path)
+		return nil, err
+	}
+	return repo, nil
+}
+
+// fetch updates the mirror, without a ref HEAD is pointed at the default
+// branch of the remote.
+func fetch(ctx context.Context, repo *gitclient.Repository, ref string, auth transport.AuthMethod) error {
+	err := repo.FetchContext(ctx, &gitclient.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   []gitclientconfig.RefSpec{mirrorRefSpec},
+		Auth:       auth,
+		Tags:       gitclient.AllTags,
+		Force:      true,
+	})
+	if err != nil && err != gitclient.NoErrAlreadyUpToDate {
+		return err
+	}
+	if ref != "" {
+		return nil
+	}
+	origin, err := repo.Remote("origin")
+	if err != nil {
+		return err
+	}
+	refs, err := origin.List(&gitclient.ListOptions{Auth: auth})
+	if err != nil {
+		return err
+	}
+	for _, r := range refs {
+		if r.Name() == plumbing.HEAD && r.Type() == plumbing.SymbolicReference {
+			return repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, r.Target()))
+		}
+	}
+	return nil
+}
+
+// extract writes the files of a commit to dir.
+func extract(repo *gitclient.Repository, hash plumbing.Hash, dir string) error {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(filepath.Dir(dir)), "extract-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	err = tree.Files().ForEach(func(f *object.File) error {
+		return writeFile(tmp, f)
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	os.RemoveAll(dir)
+	return os.Rename(tmp, dir)
+}
+
+// writeFile writes a file of a tree under dir, symlinks leaving dir are skipped.
+func writeFile(dir string, f *object.File) error {
+	path := filepath.Join(dir, filepath.FromSlash(f.Name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if f.Mode == filemode.Symlink {
+		target, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		resolved := filepath.Join(filepath.Dir(path), target)
+		if filepath.IsAbs(target) || !strings.HasPrefix(resolved, dir+string(filepath.Separator)) {
+			return nil
+		}
+		return os.Symlink(target, path)
+	}
+	mode := os.FileMode(0644)
+	if f.Mode == filemode.Executable {
+		mode = 0755
+	}
+	reader, err := f.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, reader); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// resolve finds the commit of a ref.
+func resolve(repo *gitclient.Repository, ref string) (plumbing.Hash, error) {
+	if ref == "" {
+		head, err := repo.Head()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		return head.Hash(), nil
+	}
+	if hash, err := repo.ResolveRevision(plumbing.Revision(ref)); err == nil {
+		return *hash, nil
+	}
+	// Annotated tags point to a tag object instead of a commit
+	if tagRef, err := repo.Tag(ref); err == nil {
+		if tag, err := repo.TagObject(tagRef.Hash()); err == nil {
+			if commit, err := tag.Commit(); err == nil {
+				return commit.Hash, nil
+			}
+		}
+	}
+	return plumbing.ZeroHash, fmt.Errorf("%w: %s", ErrUnknownRef, ref)
+}
@@ -0,0 +1,194 @@
+package gitfetch
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gitclient "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		remote Remote
+		ok     bool
+	}{
+		{"local", "/tmp/app", Remote{}, false},
+		{"relative", "app/overlays/prod", Remote{}, false},
+		{"ssh", "git@github.com:slipway-gitops/slipway-example-app.git//kustomize/base?ref=08c913b",
+			Remote{Repo: "git@github.com:slipway-gitops/slipway-example-app.git", Dir: "kustomize/base", Ref: "08c913b"}, true},
+		{"https", "https://github.com/slipway-gitops/slipway-example-app//kustomize/base",
+			Remote{Repo: "https://github.com/slipway-gitops/slipway-example-app", Dir: "kustomize/base"}, true},
+		{"https git suffix", "https://github.com/slipway-gitops/slipway-example-app.git/kustomize/base",
+			Remote{Repo: "https://github.com/slipway-gitops/slipway-example-app.git", Dir: "kustomize/base"}, true},
+		{"github", "github.com/slipway-gitops/slipway-example-app/kustomize/base?ref=master",
+			Remote{Repo: "https://github.com/slipway-gitops/slipway-example-app", Dir: "kustomize/base", Ref: "master"}, true},
+		{"https github", "https://github.com/slipway-gitops/slipway-example-app/kustomize/base?ref=v1",
+			Remote{Repo: "https://github.com/slipway-gitops/slipway-example-app", Dir: "kustomize/base", Ref: "v1"}, true},
+		{"ssh github", "git@github.com:slipway-gitops/slipway-example-app/kustomize/base",
+			Remote{Repo: "git@github.com:slipway-gitops/slipway-example-app", Dir: "kustomize/base"}, true},
+		{"https github root", "https://github.com/slipway-gitops/slipway-example-app",
+			Remote{Repo: "https://github.com/slipway-gitops/slipway-example-app"}, true},
+		{"other host", "https://example.com/slipway-gitops/slipway-example-app/kustomize/base",
+			Remote{Repo: "https://example.com/slipway-gitops/slipway-example-app/kustomize/base"}, true},
+		{"repo root", "ssh://git@github.com/slipway-gitops/slipway-example-app.git",
+			Remote{Repo: "ssh://git@github.com/slipway-gitops/slipway-example-app.git"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote, ok := Parse(tt.path)
+			if ok != tt.ok || remote != tt.remote {
+				t.Errorf("Expected %+v %v got %+v %v", tt.remote, tt.ok, remote, ok)
+			}
+		})
+	}
+}
+
+func TestCheckout(t *testing.T) {
+	origin, err := ioutil.TempDir("", "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(origin)
+	first := commitFile(t, origin, "app/kustomization.yaml", "resources: []\n")
+	second := commitFile(t, origin, "app/kustomization.yaml", "namePrefix: two-\n")
+
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		ref     string
+		commit  string
+		content string
+	}{
+		{"default branch", "", second, "namePrefix: two-\n"},
+		{"branch", "master", second, "namePrefix: two-\n"},
+		{"commit", first, first, "resources: []\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := w.Checkout(context.Background(), Remote{Repo: origin, Dir: "app", Ref: tt.ref}, "", nil)
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if c.Commit != tt.commit {
+				t.Errorf("Expected commit %s got %s", tt.commit, c.Commit)
+			}
+			content, err := ioutil.ReadFile(filepath.Join(c.Path, "kustomization.yaml"))
+			if err != nil || string(content) != tt.content {
+				t.Errorf("Expected %q got %q %v", tt.content, content, err)
+			}
+			if err := c.Close(); err != nil {
+				t.Error(err)
+			}
+			if _, err := os.Stat(c.Path); !os.IsNotExist(err) {
+				t.Errorf("Expected the checkout to be removed")
+			}
+		})
+	}
+	if _, err := w.Checkout(context.Background(), Remote{Repo: origin, Ref: "missing"}, "", nil); err == nil {
+		t.Errorf("Expected an unknown ref error")
+	}
+	if repos, _ := ioutil.ReadDir(filepath.Join(dir, "repos")); len(repos) != 1 {
+		t.Errorf("Expected a single mirror got %d", len(repos))
+	}
+
+	// New commits are fetched into the mirror
+	third := commitFile(t, origin, "app/kustomization.yaml", "namePrefix: three-\n")
+	c, err := w.Checkout(context.Background(), Remote{Repo: origin, Ref: "master"}, "", nil)
+	if err != nil || c.Commit != third {
+		t.Fatalf("Expected commit %s got %v", third, err)
+	}
+	// Commits in the mirror are shared with the same credentials only
+	os.RemoveAll(origin)
+	shared, err := w.Checkout(context.Background(), Remote{Repo: origin, Dir: "app", Ref: third}, "", nil)
+	if err != nil {
+		t.Fatalf("Expected a checkout from the mirror got %v", err)
+	}
+	if _, err := w.Checkout(context.Background(), Remote{Repo: origin, Dir: "app", Ref: third}, "apps/git", nil); err == nil {
+		t.Errorf("Expected other credentials to fetch from the remote")
+	}
+	c.Close()
+	if _, err := os.Stat(shared.Path); err != nil {
+		t.Errorf("Expected the checkout to be kept while in use")
+	}
+	shared.Close()
+	if _, err := os.Stat(shared.Path); !os.IsNotExist(err) {
+		t.Errorf("Expected the checkout to be removed once unused")
+	}
+}
+
+func TestCommit(t *testing.T) {
+	origin, err := ioutil.TempDir("", "origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(origin)
+	sha := commitFile(t, origin, "app/kustomization.yaml", "resources: []\n")
+
+	dir, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := w.Commit(context.Background(), origin, sha, "", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if commit.SHA != sha || commit.Author != "slipway" || commit.Email != "slipway@example.com" {
+		t.Errorf("Unexpected commit %+v", commit)
+	}
+	if commit.Message != "update app/kustomization.yaml" || commit.Time.IsZero() {
+		t.Errorf("Unexpected commit %+v", commit)
+	}
+	if _, err := w.Commit(context.Background(), origin, "0123456789012345678901234567890123456789", "", nil); err == nil {
+		t.Errorf("Expected an unknown commit error")
+	}
+}
+
+func commitFile(t *testing.T, dir, name, content string) string {
+	repo, err := gitclient.PlainOpen(dir)
+	if err == gitclient.ErrRepositoryNotExists {
+		repo, err = gitclient.PlainInit(dir, false)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Add(name); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := wt.Commit("update "+name, &gitclient.CommitOptions{
+		Author: &object.Signature{Name: "slipway", Email: "slipway@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash.String()
+}
@@ -0,0 +1,194 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+/*
+RenderCache keeps rendered manifests in memory and optionally on disk so they
+do not have to be rendered again for the same input.
+*/
+
+package rendercache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Cache is a size bounded in memory cache backed by an optional size bounded
+// directory. The least recently used entries are evicted first, from memory
+// and from disk.
+type Cache struct {
+	mu      sync.Mutex
+	dir     string
+	entries map[string][]byte
+	memory  *lru
+	disk    *lru
+}
+
+// New creates a cache holding up to size entries in memory, when dir is set
+// up to diskSize entries are also written to and read from it.
+func New(size, diskSize int, dir string) (*Cache, error) {
+	c := &Cache{
+		dir:     dir,
+		entries: make(map[string][]byte),
+		memory:  newLRU(size),
+		disk:    newLRU(diskSize),
+	}
+	if dir == "" {
+		return c, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// Entries left by a previous run are used from the oldest to the newest
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(f.Name(), ".tmp-") {
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		c.removeFiles(c.disk.use(f.Name()))
+	}
+	return c, nil
+}
+
+// Key builds a cache key from the parts of the input.
+func Key(parts ...string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(parts, "\x00"))))
+}
+
+// Get returns the data for a key from memory or disk.
+func (c *Cache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if data, ok := c.entries[key]; ok {
+		c.memory.use(key)
+		c.disk.touch(key)
+		return data, true
+	}
+	if c.dir == "" {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, key))
+	if err != nil {
+		c.disk.remove(key)
+		return nil, false
+	}
+	c.removeFiles(c.disk.use(key))
+	c.add(key, data)
+	return data, true
+}
+
+// Put saves the data for a key in memory and on disk.
+func (c *Cache) Put(key string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.add(key, data)
+	if c.dir == "" {
+		return nil
+	}
+	// Write to a temporary file first so readers never see partial data
+	tmp, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(c.dir, key)); err != nil {
+		return err
+	}
+	c.removeFiles(c.disk.use(key))
+	return nil
+}
+
+func (c *Cache) add(key string, data []byte) {
+	c.entries[key] = data
+	for _, evicted := range c.memory.use(key) {
+		delete(c.entries, evicted)
+	}
+}
+
+// removeFiles deletes the files of the entries evicted from disk.
+func (c *Cache) removeFiles(keys []string) {
+	for _, key := range keys {
+		os.Remove(filepath.Join(c.dir, key))
+	}
+}
+
+// lru orders keys from the most to the least recently used.
+type lru struct {
+	size  int
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+func newLRU(size int) *lru {
+	return &lru{
+		size:  size,
+		order: list.New(),
+		keys:  make(map[string]*list.Element),
+	}
+}
+
+// use marks a key as the most recently used and returns the keys evicted to
+// stay within the size.
+func (l *lru) use(key string) []string {
+	if e, ok := l.keys[key]; ok {
+		l.order.MoveToFront(e)
+		return nil
+	}
+	l.keys[key] = l.order.PushFront(key)
+	var evicted []string
+	for l.order.Len() > l.size {
+		e := l.order.Back()
+		l.order.Remove(e)
+		delete(l.keys, e.Value.(string))
+		evicted = append(evicted, e.Value.(string))
+	}
+	return evicted
+}
+
+// touch marks a key as the most recently used if it is known.
+func (l *lru) touch(key string) {
+	if e, ok := l.keys[key]; ok {
+		l.order.MoveToFront(e)
+	}
+}
+
+func (l *lru) remove(key string) {
+	if e, ok := l.keys[key]; ok {
+		l.order.Remove(e)
+		delete(l.keys, key)
+	}
+}
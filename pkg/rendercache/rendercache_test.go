@@ -0,0 +1,70 @@
+package rendercache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	c, err := New(2, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, d := Key("a"), Key("b"), Key("d")
+	if a == Key("a", "") {
+		t.Errorf("Expected keys with different parts to differ")
+	}
+	c.Put(a, []byte("a"))
+	c.Put(b, []byte("b"))
+	if data, ok := c.Get(a); !ok || string(data) != "a" {
+		t.Errorf("Expected a got %q", data)
+	}
+	c.Put(d, []byte("d"))
+	if _, ok := c.Get(b); ok {
+		t.Errorf("Expected the least recently used entry to be evicted")
+	}
+	if _, ok := c.Get(a); !ok {
+		t.Errorf("Expected the recently used entry to be kept")
+	}
+	if _, ok := c.Get(d); !ok {
+		t.Errorf("Expected the newest entry to be cached")
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rendercache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := New(1, 2, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := Key("a"), Key("b")
+	if err := c.Put(a, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(b, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := c.Get(a); !ok || string(data) != "a" {
+		t.Errorf("Expected a from disk got %q", data)
+	}
+	d := Key("d")
+	if err := c.Put(d, []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, b)); !os.IsNotExist(err) {
+		t.Errorf("Expected the least recently used file to be removed got %v", err)
+	}
+	restarted, err := New(1, 2, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := restarted.Get(d); !ok || string(data) != "d" {
+		t.Errorf("Expected d to survive a restart got %q", data)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+/*
+Transformer defines an interface to change the resources rendered for an
+operation with values from the reference of the operation.
+*/
+
+package transformer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"plugin"
+	"strings"
+
+	"sigs.k8s.io/kustomize/api/resmap"
+
+	gitv1 "github.com/slipway-gitops/slipway/api/v1"
+)
+
+var (
+	fileextension = ".so"
+	// General use for Invalid type.
+	ErrInvalidType      = errors.New("Invalid Transformer Type")
+	ErrInvalidInterface = errors.New("Invalid Plugin does not implement Transformer")
+)
+
+// Reference is the reference a transformer is configured for.
+type Reference struct {
+	// Hash the operation is applied for, its name is the commit
+	Hash *gitv1.Hash
+	// Operation the transformer belongs to
+	Operation gitv1.Operation
+	// Value of the transformer resolved for the reference
+	Value string
+}
+
+// Transformer is the interface a transformer plugin needs to implement
+type Transformer interface {
+	// returns a copy of itself configured for a transformer of an operation
+	New(ctx context.Context, config gitv1.Transformer, ref Reference) (Transformer, error)
+	// Changes the resources rendered for the operation
+	Transform(m resmap.ResMap) error
+}
+
+// LoadTransformers loads all the available plugins from the path, a missing
+// path has no plugins.
+func LoadTransformers(path string) (map[string]Transformer, error) {
+	transformers := make(map[string]Transformer)
+	files, err := ioutil.ReadDir(path)
+	if os.IsNotExist(err) {
+		return transformers, nil
+	}
+	if err != nil {
+		return transformers, err
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), fileextension) {
+			plug, err := plugin.Open(fmt.Sprintf("%v/%v", path, f.Name()))
+			if err != nil {
+				return transformers, err
+			}
+			symtransformer, err := plug.Lookup("Transformer")
+			if err != nil {
+				return transformers, err
+			}
+			var transformer Transformer
+			transformer, ok := symtransformer.(Transformer)
+			if !ok {
+				return transformers, ErrInvalidInterface
+			}
+			transformers[strings.TrimSuffix(f.Name(), fileextension)] = transformer
+		}
+	}
+	return transformers, nil
+}
@@ -0,0 +1,34 @@
+package transformer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadTransformers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transformers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	transformers, err := LoadTransformers(filepath.Join(dir, "missing"))
+	if err != nil || len(transformers) > 0 {
+		t.Errorf("Expected no plugins for a missing path got %d %v", len(transformers), err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("not a plugin"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	transformers, err = LoadTransformers(dir)
+	if err != nil || len(transformers) > 0 {
+		t.Errorf("Expected other files to be skipped got %d %v", len(transformers), err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.so"), []byte("not a plugin"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTransformers(dir); err == nil {
+		t.Errorf("Expected an error for an invalid plugin")
+	}
+}